@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	aclGlobal = "global"
+	aclShip   = "ship"
+	aclKey    = "key"
+	aclAllow  = "allow"
+	aclDeny   = "deny"
+)
+
+type aclRule struct {
+	action string
+	ipnet  *net.IPNet
+}
+
+type aclsDso struct {
+	mutex *sync.RWMutex
+	dao   Dao
+	rules map[string][]*aclRule
+}
+
+type Acls interface {
+	Allowed(scope, name string, ip net.IP) bool
+	Reload()
+}
+
+func NewAcls(dao Dao) Acls {
+	dso := &aclsDso{}
+	dso.mutex = &sync.RWMutex{}
+	dso.dao = dao
+	dso.Reload()
+	return dso
+}
+
+func (dso *aclsDso) Allowed(scope, name string, ip net.IP) bool {
+	//deny wins, allow rules turn the scope into an allowlist
+	dso.mutex.RLock()
+	defer dso.mutex.RUnlock()
+	rules := dso.rules[scope+"\n"+name]
+	allowed := true
+	for _, rule := range rules {
+		if rule.action == aclAllow {
+			allowed = false
+			break
+		}
+	}
+	for _, rule := range rules {
+		if rule.ipnet.Contains(ip) {
+			if rule.action == aclDeny {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+func (dso *aclsDso) Reload() {
+	rules := make(map[string][]*aclRule)
+	for _, dro := range dso.dao.ListAcls() {
+		ipnet, err := parseCidr(dro.Cidr)
+		if err != nil {
+			log.Println("Ignoring invalid acl", dro.ID, err)
+			continue
+		}
+		key := dro.Scope + "\n" + dro.Name
+		rules[key] = append(rules[key], &aclRule{dro.Action, ipnet})
+	}
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.rules = rules
+}
+
+func parseCidr(text string) (*net.IPNet, error) {
+	//plain addresses match a single host
+	if !strings.Contains(text, "/") {
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %s", text)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(text)
+	return ipnet, err
+}
+
+func validAcl(scope, name, action, cidr string) error {
+	switch scope {
+	case aclGlobal:
+		if len(name) > 0 {
+			return fmt.Errorf("global acl takes no name")
+		}
+	case aclShip, aclKey:
+		if len(name) == 0 {
+			return fmt.Errorf("name required")
+		}
+	default:
+		return fmt.Errorf("invalid scope %s", scope)
+	}
+	if action != aclAllow && action != aclDeny {
+		return fmt.Errorf("invalid action %s", action)
+	}
+	_, err := parseCidr(cidr)
+	return err
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+type aclsDao struct {
+	Dao
+	acls []*AclDro
+}
+
+func (dao *aclsDao) ListAcls() []*AclDro {
+	return dao.acls
+}
+
+func TestParseCidr(t *testing.T) {
+	cases := []struct {
+		text  string
+		cidr  string
+		fails bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"10.1.2.3/8", "10.0.0.0/8", false},
+		{"192.168.1.10", "192.168.1.10/32", false},
+		{"::1", "::1/128", false},
+		{"fd00::/8", "fd00::/8", false},
+		{"::ffff:10.0.0.1", "10.0.0.1/32", false},
+		{"0.0.0.0/0", "0.0.0.0/0", false},
+		{"", "", true},
+		{"10.0.0.0/33", "", true},
+		{"10.0.0.256", "", true},
+		{"host.lan", "", true},
+		{"10.0.0.0/", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.text, func(t *testing.T) {
+			ipnet, err := parseCidr(c.text)
+			if (err != nil) != c.fails {
+				t.Fatalf("err %v fails %v", err, c.fails)
+			}
+			if err == nil && ipnet.String() != c.cidr {
+				t.Fatalf("cidr %s expected %s", ipnet, c.cidr)
+			}
+		})
+	}
+}
+
+func TestAclsAllowed(t *testing.T) {
+	dao := &aclsDao{acls: []*AclDro{
+		{Scope: aclGlobal, Action: aclDeny, Cidr: "203.0.113.0/24"},
+		{Scope: aclShip, Name: "office", Action: aclAllow, Cidr: "192.168.1.0/24"},
+		{Scope: aclShip, Name: "office", Action: aclAllow, Cidr: "fd00::/8"},
+		{Scope: aclShip, Name: "office", Action: aclDeny, Cidr: "192.168.1.66"},
+		{Scope: aclKey, Name: "ca/dev", Action: aclAllow, Cidr: "10.0.0.1"},
+		{Scope: aclKey, Name: "ca/dev", Action: aclAllow, Cidr: "bad"},
+		{Scope: aclKey, Name: "broken", Action: aclAllow, Cidr: "bad"},
+	}}
+	acls := NewAcls(dao)
+	cases := []struct {
+		name    string
+		scope   string
+		rule    string
+		ip      string
+		allowed bool
+	}{
+		{"global deny", aclGlobal, "", "203.0.113.7", false},
+		{"global other", aclGlobal, "", "198.51.100.7", true},
+		{"global mapped deny", aclGlobal, "", "::ffff:203.0.113.7", false},
+		{"allowlist match", aclShip, "office", "192.168.1.20", true},
+		{"allowlist mapped match", aclShip, "office", "::ffff:192.168.1.20", true},
+		{"allowlist ipv6 match", aclShip, "office", "fd12::5", true},
+		{"allowlist miss", aclShip, "office", "192.168.2.20", false},
+		{"deny wins over allow", aclShip, "office", "192.168.1.66", false},
+		{"scopes are separate", aclShip, "lab", "203.0.113.7", true},
+		{"names are separate", aclShip, "", "192.168.2.20", true},
+		{"key allow", aclKey, "ca/dev", "10.0.0.1", true},
+		{"key miss", aclKey, "ca/dev", "10.0.0.2", false},
+		{"invalid rules ignored", aclKey, "broken", "10.0.0.2", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			allowed := acls.Allowed(c.scope, c.rule, net.ParseIP(c.ip))
+			if allowed != c.allowed {
+				t.Fatalf("allowed %v expected %v", allowed, c.allowed)
+			}
+		})
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	cases := []struct {
+		addr net.Addr
+		ip   string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}, "10.0.0.1"},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 22}, "::1"},
+		{&net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 53}, "fd00::1"},
+		{&net.UnixAddr{Name: "/tmp/dock.sock", Net: "unix"}, "<nil>"},
+	}
+	for _, c := range cases {
+		t.Run(c.addr.String(), func(t *testing.T) {
+			ip := addrIP(c.addr)
+			if ip.String() != c.ip {
+				t.Fatalf("ip %s expected %s", ip, c.ip)
+			}
+		})
+	}
+}
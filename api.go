@@ -2,24 +2,80 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	neturl "net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/samuelventura/go-tree"
+	"golang.org/x/crypto/ssh"
 )
 
 func api(node tree.Node) {
 	dao := node.GetValue("dao").(Dao)
+	keys := node.GetValue("keys").(Keys)
+	limiter := node.GetValue("limiter").(Limiter)
+	acls := node.GetValue("acls").(Acls)
+	policies := node.GetValue("policies").(Policies)
+	hooks := node.GetValue("hooks").(Hooks)
 	ships := node.GetValue("ships").(Ships)
+	metrics := node.GetValue("metrics").(Metrics)
+	events := node.GetValue("events").(Events)
+	hostname := node.GetValue("hostname").(string)
 	endpoint := node.GetValue("endpoint").(string)
+	auth := node.GetValue("auth").(bool)
+	token := node.GetValue("token").(string)
+	cert := node.GetValue("cert").(string)
+	certkey := node.GetValue("certkey").(string)
+	clientca := node.GetValue("clientca").(string)
 	gin.SetMode(gin.ReleaseMode) //remove debug warning
 	router := gin.New()          //remove default logger
 	router.Use(gin.Recovery())   //looks important
+	if auth {
+		router.Use(authMiddleware(dao, token))
+	}
+	//successful posts are config changes
+	router.Use(func(c *gin.Context) {
+		c.Next()
+		if c.Request.Method != http.MethodPost || c.Writer.Status() != 200 {
+			return
+		}
+		ship := c.Param("ship")
+		if strings.HasPrefix(c.FullPath(), "/api/ship/") {
+			ship = c.Param("name")
+		}
+		events.Publish(&Event{Type: "config", Ship: ship, Host: hostname,
+			Detail: c.Request.URL.Path})
+	})
+	router.GET("/api/events", func(c *gin.Context) {
+		id, channel := events.Subscribe(c.Query("ship"))
+		defer events.Unsubscribe(id)
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event := <-channel:
+				c.SSEvent(event.Type, event)
+				return true
+			case <-ticker.C:
+				c.SSEvent("keepalive", time.Now())
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	})
+	router.GET("/metrics", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4")
+		metrics.Write(c.Writer, ships.Count())
+	})
 	rkapi := router.Group("/api/key")
 	rkapi.GET("/list", func(c *gin.Context) {
 		list := dao.ListKeys()
@@ -41,6 +97,7 @@ func api(node tree.Node) {
 			c.JSON(400, fmt.Sprintf("err: %v", err))
 			return
 		}
+		keys.Reload()
 		c.JSON(200, "ok")
 	})
 	rkapi.POST("/enable/:name", func(c *gin.Context) {
@@ -50,6 +107,7 @@ func api(node tree.Node) {
 			c.JSON(400, fmt.Sprintf("err: %v", err))
 			return
 		}
+		keys.Reload()
 		c.JSON(200, "ok")
 	})
 	rkapi.POST("/disable/:name", func(c *gin.Context) {
@@ -59,6 +117,7 @@ func api(node tree.Node) {
 			c.JSON(400, fmt.Sprintf("err: %v", err))
 			return
 		}
+		keys.Reload()
 		c.JSON(200, "ok")
 	})
 	rkapi.POST("/add/:name", func(c *gin.Context) {
@@ -85,8 +144,543 @@ func api(node tree.Node) {
 			c.JSON(400, fmt.Sprintf("err: %v", err))
 			return
 		}
+		keys.Reload()
+		c.JSON(200, "ok")
+	})
+	rkapi.POST("/role/:name/:role", func(c *gin.Context) {
+		name := c.Param("name")
+		role := c.Param("role")
+		//ship is the default role
+		if role == "ship" {
+			role = roleShip
+		}
+		if !validRole(role) {
+			c.JSON(400, fmt.Sprintf("err: invalid role %s", role))
+			return
+		}
+		err := dao.RoleKey(name, role)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		keys.Reload()
+		c.JSON(200, "ok")
+	})
+	rkapi.GET("/ships/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		list := dao.ListGrants(name)
+		c.JSON(200, list)
+	})
+	rkapi.POST("/grant/:name/:ship", func(c *gin.Context) {
+		name := c.Param("name")
+		ship := c.Param("ship")
+		err := dao.AddGrant(name, ship)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		keys.Reload()
+		c.JSON(200, "ok")
+	})
+	rkapi.POST("/revoke/:name/:ship", func(c *gin.Context) {
+		name := c.Param("name")
+		ship := c.Param("ship")
+		err := dao.DelGrant(name, ship)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		keys.Reload()
+		c.JSON(200, "ok")
+	})
+	rcapi := router.Group("/api/ca")
+	rcapi.GET("/list", func(c *gin.Context) {
+		list := dao.ListCas()
+		c.JSON(200, list)
+	})
+	rcapi.GET("/info/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		row, err := dao.GetCa(name)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, row)
+	})
+	rcapi.POST("/delete/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		err := dao.DelCa(name)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		keys.Reload()
+		c.JSON(200, "ok")
+	})
+	rcapi.POST("/enable/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		err := dao.EnableCa(name, true)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		keys.Reload()
+		c.JSON(200, "ok")
+	})
+	rcapi.POST("/disable/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		err := dao.EnableCa(name, false)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		keys.Reload()
+		c.JSON(200, "ok")
+	})
+	rcapi.POST("/add/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		src, err := file.Open()
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		defer src.Close()
+		buf := bytes.NewBuffer(nil)
+		_, err = io.Copy(buf, src)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		_, _, _, _, err = ssh.ParseAuthorizedKey(buf.Bytes())
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		err = dao.AddCa(name, buf.String())
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		keys.Reload()
+		c.JSON(200, "ok")
+	})
+	rcapi.GET("/revoked/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		list := dao.ListRevoked(name)
+		c.JSON(200, list)
+	})
+	rcapi.POST("/revoke/:name/:serial", func(c *gin.Context) {
+		name := c.Param("name")
+		serial := c.Param("serial")
+		sv, err := strconv.ParseUint(serial, 10, 64)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		err = dao.RevokeSerial(name, sv)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		keys.Reload()
+		c.JSON(200, "ok")
+	})
+	rcapi.POST("/unrevoke/:name/:serial", func(c *gin.Context) {
+		name := c.Param("name")
+		serial := c.Param("serial")
+		sv, err := strconv.ParseUint(serial, 10, 64)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		err = dao.UnrevokeSerial(name, sv)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		keys.Reload()
+		c.JSON(200, "ok")
+	})
+	rtapi := router.Group("/api/token")
+	rtapi.GET("/list", func(c *gin.Context) {
+		list := dao.ListTokens()
+		c.JSON(200, list)
+	})
+	rtapi.GET("/info/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		row, err := dao.GetToken(name)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, row)
+	})
+	rtapi.POST("/delete/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		err := dao.DelToken(name)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, "ok")
+	})
+	rtapi.POST("/enable/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		err := dao.EnableToken(name, true)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, "ok")
+	})
+	rtapi.POST("/disable/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		err := dao.EnableToken(name, false)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, "ok")
+	})
+	//the secret is only returned here
+	rtapi.POST("/add/:name/:scope", func(c *gin.Context) {
+		name := c.Param("name")
+		scope := c.Param("scope")
+		if !validScope(scope) {
+			c.JSON(400, fmt.Sprintf("err: invalid scope %s", scope))
+			return
+		}
+		secret, err := newToken()
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		err = dao.AddToken(name, secret, scope)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, secret)
+	})
+	rlapi := router.Group("/api/log")
+	rlapi.GET("/list", func(c *gin.Context) {
+		filter, err := parseLogFilter(c)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		list := dao.ListLogs(filter)
+		next := nextLogCursor(list, filter.Limit)
+		if c.Query("format") == "csv" {
+			data, err := logsCsv(list)
+			if err != nil {
+				c.JSON(400, fmt.Sprintf("err: %v", err))
+				return
+			}
+			c.Header("X-Next-Cursor", next)
+			c.Data(200, "text/csv", data)
+			return
+		}
+		c.JSON(200, gin.H{"items": list, "next": next})
+	})
+	//pairs add/del events by sid, the add event drives pagination
+	rlapi.GET("/sessions", func(c *gin.Context) {
+		filter, err := parseLogFilter(c)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		filter.Event = "add"
+		adds := dao.ListLogs(filter)
+		sids := make([]string, 0, len(adds))
+		for _, dro := range adds {
+			sids = append(sids, dro.Sid)
+		}
+		dels := dao.FindLogs("del", sids)
+		next := nextLogCursor(adds, filter.Limit)
+		c.JSON(200, gin.H{"items": logSessions(adds, dels), "next": next})
+	})
+	rhapi := router.Group("/api/hook")
+	rhapi.GET("/list", func(c *gin.Context) {
+		list := dao.ListHooks()
+		c.JSON(200, list)
+	})
+	rhapi.GET("/info/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		row, err := dao.GetHook(name)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, row)
+	})
+	rhapi.GET("/log/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		list := dao.ListDeliveries(name, 100)
+		c.JSON(200, list)
+	})
+	rhapi.POST("/delete/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		err := dao.DelHook(name)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		hooks.Reload()
+		c.JSON(200, "ok")
+	})
+	rhapi.POST("/enable/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		err := dao.EnableHook(name, true)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		hooks.Reload()
+		c.JSON(200, "ok")
+	})
+	rhapi.POST("/disable/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		err := dao.EnableHook(name, false)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		hooks.Reload()
 		c.JSON(200, "ok")
 	})
+	//the signing secret is only returned here
+	rhapi.POST("/add/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		url := c.PostForm("url")
+		parsed, err := neturl.Parse(url)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			c.JSON(400, fmt.Sprintf("err: invalid url %s", url))
+			return
+		}
+		secret, err := newToken()
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		err = dao.AddHook(name, url, secret)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		hooks.Reload()
+		c.JSON(200, secret)
+	})
+	raapi := router.Group("/api/acl")
+	raapi.GET("/list", func(c *gin.Context) {
+		list := dao.ListAcls()
+		c.JSON(200, list)
+	})
+	raapi.POST("/add/:scope/:action", func(c *gin.Context) {
+		scope := c.Param("scope")
+		action := c.Param("action")
+		name := c.PostForm("name")
+		cidr := c.PostForm("cidr")
+		err := validAcl(scope, name, action, cidr)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		dro, err := dao.AddAcl(scope, name, action, cidr)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		acls.Reload()
+		c.JSON(200, dro)
+	})
+	raapi.POST("/delete/:id", func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		err = dao.DelAcl(uint(id))
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		acls.Reload()
+		c.JSON(200, "ok")
+	})
+	rsapi := router.Group("/api/consumer")
+	rsapi.GET("/list/:ship", func(c *gin.Context) {
+		ship := c.Param("ship")
+		list := dao.ListConsumers(ship)
+		c.JSON(200, list)
+	})
+	rsapi.GET("/info/:ship/:name", func(c *gin.Context) {
+		ship := c.Param("ship")
+		name := c.Param("name")
+		row, err := dao.GetConsumer(ship, name)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, row)
+	})
+	rsapi.POST("/delete/:ship/:name", func(c *gin.Context) {
+		ship := c.Param("ship")
+		name := c.Param("name")
+		err := dao.DelConsumer(ship, name)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, "ok")
+	})
+	rsapi.POST("/enable/:ship/:name", func(c *gin.Context) {
+		ship := c.Param("ship")
+		name := c.Param("name")
+		err := dao.EnableConsumer(ship, name, true)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, "ok")
+	})
+	rsapi.POST("/disable/:ship/:name", func(c *gin.Context) {
+		ship := c.Param("ship")
+		name := c.Param("name")
+		err := dao.EnableConsumer(ship, name, false)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, "ok")
+	})
+	rsapi.POST("/add/:ship/:name", func(c *gin.Context) {
+		//secret is returned once, only its hash is stored
+		ship := c.Param("ship")
+		name := c.Param("name")
+		if name == "-" || strings.ContainsAny(name, ": \t") {
+			c.JSON(400, fmt.Sprintf("err: invalid name %s", name))
+			return
+		}
+		secret, err := newToken()
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		hash, err := hashSecret(secret)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		err = dao.AddConsumer(ship, name, hash)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, secret)
+	})
+	rpapi := router.Group("/api/policy")
+	rpapi.GET("/list", func(c *gin.Context) {
+		list := dao.ListPolicies(c.Query("ship"))
+		c.JSON(200, list)
+	})
+	rpapi.POST("/add/:ship", func(c *gin.Context) {
+		ship := c.Param("ship")
+		host := c.PostForm("host")
+		ports := c.PostForm("ports")
+		_, err := parsePolicy(host, ports)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		dro, err := dao.AddPolicy(ship, host, ports)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		policies.Reload()
+		c.JSON(200, dro)
+	})
+	rpapi.POST("/delete/:id", func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		err = dao.DelPolicy(uint(id))
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		policies.Reload()
+		c.JSON(200, "ok")
+	})
+	rnapi := router.Group("/api/ban")
+	rnapi.GET("/list", func(c *gin.Context) {
+		list := dao.ListBans(time.Now())
+		c.JSON(200, list)
+	})
+	rnapi.POST("/delete/:ip", func(c *gin.Context) {
+		ip := c.Param("ip")
+		err := dao.DelBan(ip)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		limiter.Unban(ip)
+		c.JSON(200, "ok")
+	})
+	rnapi.POST("/clear", func(c *gin.Context) {
+		count := dao.ClearBans()
+		limiter.Reload()
+		c.JSON(200, count)
+	})
+	rbapi := router.Group("/api/bulk")
+	rbapi.POST("/import", func(c *gin.Context) {
+		dry := c.Query("dry") == "true"
+		enabled := c.Query("enabled") == "true"
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		doc, results := parseBulk(c.DefaultQuery("format", "json"), data, enabled)
+		if doc != nil {
+			results = append(results, validateBulk(doc)...)
+		}
+		if doc == nil || bulkFailed(results) {
+			c.JSON(400, gin.H{"dry": dry, "committed": false, "results": results})
+			return
+		}
+		err = dao.Import(doc, dry)
+		if err != nil {
+			c.JSON(400, gin.H{"dry": dry, "committed": false, "results": results,
+				"error": err.Error()})
+			return
+		}
+		keys.Reload()
+		acls.Reload()
+		policies.Reload()
+		c.JSON(200, gin.H{"dry": dry, "committed": !dry, "results": results})
+	})
+	rbapi.GET("/export", func(c *gin.Context) {
+		doc := dao.Export()
+		if c.Query("format") == "csv" {
+			data, err := bulkCsv(doc)
+			if err != nil {
+				c.JSON(400, fmt.Sprintf("err: %v", err))
+				return
+			}
+			c.Data(200, "text/csv", data)
+			return
+		}
+		c.JSON(200, doc)
+	})
 	skapi := router.Group("/api/ship")
 	skapi.GET("/count", func(c *gin.Context) {
 		count := dao.CountShips()
@@ -100,6 +694,35 @@ func api(node tree.Node) {
 		count := dao.CountDisabledShips()
 		c.JSON(200, count)
 	})
+	skapi.GET("/list", func(c *gin.Context) {
+		live := ships.List()
+		list := []*ShipStatus{}
+		for _, dro := range dao.ListShips() {
+			list = append(list, shipStatus(dro, live[dro.Name], metrics))
+		}
+		result, err := listShips(c, list)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, result)
+	})
+	skapi.GET("/connected", func(c *gin.Context) {
+		live := ships.List()
+		list := []*ShipStatus{}
+		for _, dro := range dao.ListShips() {
+			node, ok := live[dro.Name]
+			if ok {
+				list = append(list, shipStatus(dro, node, metrics))
+			}
+		}
+		result, err := listShips(c, list)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, result)
+	})
 	skapi.GET("/info/:name", func(c *gin.Context) {
 		name := c.Param("name")
 		row, err := dao.GetShip(name)
@@ -124,19 +747,45 @@ func api(node tree.Node) {
 		node := ships.Get(name)
 		port := -1
 		ip := ""
+		path := ""
 		id := ""
 		key := ""
 		hostname := ""
 		if node != nil {
 			id = node.Name()
-			port = node.GetValue("proxy").(int)
-			ip = node.GetValue("export").(string)
+			port = node.GetValue("proxyport").(int)
+			path = exportPath(node.GetValue("proxy").(string), port)
+			if len(path) == 0 {
+				ip = node.GetValue("export").(string)
+			}
 			key = node.GetValue("key").(string)
 			hostname = node.GetValue("hostname").(string)
 		}
-		c.JSON(200, gin.H{"ip": ip, "port": port, "key": key,
+		c.JSON(200, gin.H{"ip": ip, "port": port, "path": path, "key": key,
 			"host": hostname, "id": id, "name": name})
 	})
+	skapi.GET("/usage/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		to := time.Now()
+		from := to.Add(-24 * time.Hour)
+		var err error
+		if value := c.Query("to"); len(value) > 0 {
+			to, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(400, fmt.Sprintf("err: %v", err))
+				return
+			}
+		}
+		if value := c.Query("from"); len(value) > 0 {
+			from, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(400, fmt.Sprintf("err: %v", err))
+				return
+			}
+		}
+		list := dao.ShipUsage(name, from, to)
+		c.JSON(200, list)
+	})
 	skapi.POST("/close/:name", func(c *gin.Context) {
 		name := c.Param("name")
 		node := ships.Get(name)
@@ -147,6 +796,15 @@ func api(node tree.Node) {
 		node.Close()
 		c.JSON(200, "ok")
 	})
+	skapi.POST("/evict/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		err := dao.EvictShip(name)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, "ok")
+	})
 	skapi.POST("/add/:name", func(c *gin.Context) {
 		name := c.Param("name")
 		err := dao.AddShip(name)
@@ -171,6 +829,32 @@ func api(node tree.Node) {
 		}
 		c.JSON(200, "ok")
 	})
+	skapi.POST("/auth/:name/:mode", func(c *gin.Context) {
+		name := c.Param("name")
+		mode := c.Param("mode")
+		//none disables consumer auth
+		if mode == "none" {
+			mode = consumerNone
+		}
+		if !validConsumerMode(mode) {
+			c.JSON(400, fmt.Sprintf("err: invalid mode %s", mode))
+			return
+		}
+		err := dao.AuthShip(name, mode)
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, "ok")
+	})
+	skapi.POST("/reclaim", func(c *gin.Context) {
+		list, err := dao.ReclaimPorts()
+		if err != nil {
+			c.JSON(400, fmt.Sprintf("err: %v", err))
+			return
+		}
+		c.JSON(200, list)
+	})
 	skapi.POST("/enable/:name", func(c *gin.Context) {
 		name := c.Param("name")
 		err := dao.EnableShip(name, true)
@@ -196,6 +880,12 @@ func api(node tree.Node) {
 	node.AddCloser("listen", listen.Close)
 	port := listen.Addr().(*net.TCPAddr).Port
 	log.Println("port api", port)
+	if len(cert) > 0 {
+		certs := NewCerts(cert, certkey, clientca, auth)
+		config := &tls.Config{GetConfigForClient: certs.Config}
+		listen = tls.NewListener(listen, config)
+		log.Println("tls api", cert)
+	}
 	server := &http.Server{
 		Addr:    endpoint,
 		Handler: router,
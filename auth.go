@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	scopeRead  = "read"
+	scopeAdmin = "admin"
+)
+
+const hmacWindow = 5 * time.Minute
+
+func validScope(scope string) bool {
+	return scope == scopeRead || scope == scopeAdmin
+}
+
+func newToken() (string, error) {
+	ba := make([]byte, 32)
+	_, err := rand.Read(ba)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(ba), nil
+}
+
+func authMiddleware(dao Dao, bootstrap string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope, err := authenticate(dao, bootstrap, c)
+		if err != nil {
+			c.AbortWithStatusJSON(401, fmt.Sprintf("err: %v", err))
+			return
+		}
+		if c.Request.Method != http.MethodGet && scope != scopeAdmin {
+			c.AbortWithStatusJSON(403, "err: admin scope required")
+			return
+		}
+		c.Set("scope", scope)
+		c.Next()
+	}
+}
+
+func authenticate(dao Dao, bootstrap string, c *gin.Context) (string, error) {
+	//verified client certificate common name maps to token name
+	tls := c.Request.TLS
+	if tls != nil && len(tls.VerifiedChains) > 0 {
+		cn := tls.VerifiedChains[0][0].Subject.CommonName
+		dro, err := dao.GetToken(cn)
+		if err != nil || !dro.Enabled {
+			return "", fmt.Errorf("certificate not authorized")
+		}
+		return dro.Scope, nil
+	}
+	name := c.GetHeader("X-Dock-Token")
+	if len(name) > 0 {
+		return authenticateHmac(dao, name, c)
+	}
+	auth := c.GetHeader("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", fmt.Errorf("credentials required")
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	if len(bootstrap) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(bootstrap)) == 1 {
+		return scopeAdmin, nil
+	}
+	dro, err := dao.FindToken(token)
+	if err != nil || !dro.Enabled {
+		return "", fmt.Errorf("invalid token")
+	}
+	return dro.Scope, nil
+}
+
+func authenticateHmac(dao Dao, name string, c *gin.Context) (string, error) {
+	dro, err := dao.GetToken(name)
+	if err != nil || !dro.Enabled {
+		return "", fmt.Errorf("invalid token")
+	}
+	date := c.GetHeader("X-Dock-Date")
+	secs, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid date")
+	}
+	skew := time.Since(time.Unix(secs, 0))
+	if skew > hmacWindow || skew < -hmacWindow {
+		return "", fmt.Errorf("date out of range")
+	}
+	nonce := c.GetHeader("X-Dock-Nonce")
+	if len(nonce) < 16 || len(nonce) > 64 {
+		return "", fmt.Errorf("invalid nonce")
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return "", err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	expected := signRequest(dro.Token, c.Request.Method, c.Request.URL.RequestURI(), date, nonce, body)
+	signature := c.GetHeader("X-Dock-Signature")
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", fmt.Errorf("invalid signature")
+	}
+	//only signed nonces are remembered, in the database so a request
+	//replayed to another instance is rejected too, until the date expires
+	if !dao.UseNonce(name+" "+nonce, time.Unix(secs, 0).Add(hmacWindow)) {
+		return "", fmt.Errorf("nonce reused")
+	}
+	return dro.Scope, nil
+}
+
+func signRequest(secret, method, uri, date, nonce string, body []byte) string {
+	hash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, date, nonce, hex.EncodeToString(hash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
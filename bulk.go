@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type BulkKey struct {
+	Name    string
+	Key     string
+	Enabled bool
+	Role    string
+	Ships   []string
+}
+
+type BulkShip struct {
+	Name    string
+	Port    int
+	Enabled bool
+	Auth    string
+}
+
+type BulkCa struct {
+	Name    string
+	Key     string
+	Enabled bool
+	Revoked []uint64
+}
+
+type BulkAcl struct {
+	Scope  string
+	Name   string
+	Action string
+	Cidr   string
+}
+
+type BulkPolicy struct {
+	Ship  string
+	Host  string
+	Ports string
+}
+
+type BulkDoc struct { //tokens, hooks and consumers secrets are left out
+	Keys     []*BulkKey
+	Ships    []*BulkShip
+	Cas      []*BulkCa
+	Acls     []*BulkAcl
+	Policies []*BulkPolicy
+}
+
+type BulkResult struct {
+	Kind  string
+	Name  string
+	Error string
+}
+
+func parseBulk(format string, data []byte, enabled bool) (*BulkDoc, []*BulkResult) {
+	switch format {
+	case "json":
+		doc := &BulkDoc{}
+		err := json.Unmarshal(data, doc)
+		if err != nil {
+			return nil, []*BulkResult{{Kind: "doc", Error: err.Error()}}
+		}
+		return doc, nil
+	case "csv":
+		return parseBulkCsv(data)
+	case "keys":
+		return parseBulkKeys(data, enabled)
+	}
+	return nil, []*BulkResult{{Kind: "doc", Error: fmt.Sprintf("invalid format %s", format)}}
+}
+
+func parseBulkCsv(data []byte) (*BulkDoc, []*BulkResult) {
+	//kind,name,value,enabled,option (key role, ship auth, acl action or policy ports)
+	//acl names are scope/name as in ship/sample or just global
+	doc := &BulkDoc{}
+	results := []*BulkResult{}
+	keys := make(map[string]*BulkKey)
+	cas := make(map[string]*BulkCa)
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	line := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			results = append(results, &BulkResult{Kind: "csv", Error: err.Error()})
+			break
+		}
+		if line == 1 && record[0] == "kind" {
+			continue
+		}
+		if len(record) < 3 {
+			results = append(results, &BulkResult{Kind: "csv",
+				Error: fmt.Sprintf("line %d: expected kind,name,value,enabled", line)})
+			continue
+		}
+		kind, name, value := record[0], record[1], record[2]
+		enabled := len(record) > 3 && record[3] == "true"
+		switch kind {
+		case "key":
+			key := &BulkKey{Name: name, Key: value, Enabled: enabled}
+			if len(record) > 4 {
+				key.Role = record[4]
+			}
+			keys[name] = key
+			doc.Keys = append(doc.Keys, key)
+		case "ship":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				results = append(results, &BulkResult{Kind: kind, Name: name, Error: err.Error()})
+				continue
+			}
+			ship := &BulkShip{Name: name, Port: port, Enabled: enabled}
+			if len(record) > 4 {
+				ship.Auth = record[4]
+			}
+			doc.Ships = append(doc.Ships, ship)
+		case "grant":
+			key, ok := keys[name]
+			if !ok {
+				key = &BulkKey{Name: name}
+				keys[name] = key
+				doc.Keys = append(doc.Keys, key)
+			}
+			key.Ships = append(key.Ships, value)
+		case "ca":
+			ca := &BulkCa{Name: name, Key: value, Enabled: enabled}
+			cas[name] = ca
+			doc.Cas = append(doc.Cas, ca)
+		case "revoke":
+			serial, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				results = append(results, &BulkResult{Kind: kind, Name: name, Error: err.Error()})
+				continue
+			}
+			ca, ok := cas[name]
+			if !ok {
+				results = append(results, &BulkResult{Kind: kind, Name: name, Error: "ca must precede revoke"})
+				continue
+			}
+			ca.Revoked = append(ca.Revoked, serial)
+		case "acl":
+			scoped := strings.SplitN(name, "/", 2)
+			acl := &BulkAcl{Scope: scoped[0], Cidr: value}
+			if len(scoped) > 1 {
+				acl.Name = scoped[1]
+			}
+			if len(record) > 4 {
+				acl.Action = record[4]
+			}
+			doc.Acls = append(doc.Acls, acl)
+		case "policy":
+			policy := &BulkPolicy{Ship: name, Host: value}
+			if len(record) > 4 {
+				policy.Ports = record[4]
+			}
+			doc.Policies = append(doc.Policies, policy)
+		default:
+			results = append(results, &BulkResult{Kind: kind, Name: name,
+				Error: fmt.Sprintf("line %d: invalid kind", line)})
+		}
+	}
+	return doc, results
+}
+
+func parseBulkKeys(data []byte, enabled bool) (*BulkDoc, []*BulkResult) {
+	//authorized_keys, the comment is the key name
+	doc := &BulkDoc{}
+	results := []*BulkResult{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		pubkey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+		if err != nil {
+			results = append(results, &BulkResult{Kind: "key",
+				Error: fmt.Sprintf("line %d: %v", line, err)})
+			continue
+		}
+		if len(comment) == 0 {
+			results = append(results, &BulkResult{Kind: "key",
+				Error: fmt.Sprintf("line %d: comment required as key name", line)})
+			continue
+		}
+		key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubkey))) + " " + comment
+		doc.Keys = append(doc.Keys, &BulkKey{Name: comment, Key: key, Enabled: enabled})
+	}
+	err := scanner.Err()
+	if err != nil {
+		results = append(results, &BulkResult{Kind: "key", Error: err.Error()})
+	}
+	return doc, results
+}
+
+func validateBulk(doc *BulkDoc) []*BulkResult {
+	results := []*BulkResult{}
+	for _, key := range doc.Keys {
+		result := &BulkResult{Kind: "key", Name: key.Name}
+		if len(key.Name) == 0 {
+			result.Error = "name required"
+		} else if !validRole(key.Role) {
+			result.Error = fmt.Sprintf("invalid role %s", key.Role)
+		} else if len(key.Key) > 0 {
+			_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
+			if err != nil {
+				result.Error = err.Error()
+			}
+		} else if len(key.Ships) == 0 {
+			result.Error = "key or ships required"
+		}
+		results = append(results, result)
+	}
+	for _, ship := range doc.Ships {
+		result := &BulkResult{Kind: "ship", Name: ship.Name}
+		if len(ship.Name) == 0 {
+			result.Error = "name required"
+		} else if ship.Port < 0 || ship.Port > 65535 {
+			result.Error = fmt.Sprintf("invalid port %d", ship.Port)
+		} else if !validConsumerMode(ship.Auth) {
+			result.Error = fmt.Sprintf("invalid auth %s", ship.Auth)
+		}
+		results = append(results, result)
+	}
+	for _, ca := range doc.Cas {
+		result := &BulkResult{Kind: "ca", Name: ca.Name}
+		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ca.Key))
+		if len(ca.Name) == 0 {
+			result.Error = "name required"
+		} else if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	for _, acl := range doc.Acls {
+		result := &BulkResult{Kind: "acl", Name: strings.TrimSuffix(acl.Scope+"/"+acl.Name, "/")}
+		err := validAcl(acl.Scope, acl.Name, acl.Action, acl.Cidr)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	for _, policy := range doc.Policies {
+		result := &BulkResult{Kind: "policy", Name: policy.Ship}
+		_, err := parsePolicy(policy.Host, policy.Ports)
+		if len(policy.Ship) == 0 {
+			result.Error = "ship required"
+		} else if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func bulkCsv(doc *BulkDoc) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	writer := csv.NewWriter(buf)
+	records := [][]string{{"kind", "name", "value", "enabled", "option"}}
+	for _, key := range doc.Keys {
+		enabled := strconv.FormatBool(key.Enabled)
+		records = append(records, []string{"key", key.Name, strings.TrimSpace(key.Key), enabled, key.Role})
+		for _, ship := range key.Ships {
+			records = append(records, []string{"grant", key.Name, ship, ""})
+		}
+	}
+	for _, ship := range doc.Ships {
+		enabled := strconv.FormatBool(ship.Enabled)
+		records = append(records, []string{"ship", ship.Name, strconv.Itoa(ship.Port), enabled, ship.Auth})
+	}
+	for _, ca := range doc.Cas {
+		enabled := strconv.FormatBool(ca.Enabled)
+		records = append(records, []string{"ca", ca.Name, strings.TrimSpace(ca.Key), enabled})
+		for _, serial := range ca.Revoked {
+			records = append(records, []string{"revoke", ca.Name, strconv.FormatUint(serial, 10), ""})
+		}
+	}
+	for _, acl := range doc.Acls {
+		name := acl.Scope
+		if len(acl.Name) > 0 {
+			name += "/" + acl.Name
+		}
+		records = append(records, []string{"acl", name, acl.Cidr, "", acl.Action})
+	}
+	for _, policy := range doc.Policies {
+		records = append(records, []string{"policy", policy.Ship, policy.Host, "", policy.Ports})
+	}
+	err := writer.WriteAll(records)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func bulkFailed(results []*BulkResult) bool {
+	for _, result := range results {
+		if len(result.Error) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func certAuth(keys Keys, conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	//principals are checked against the ship name (conn.User)
+	//validity window and critical options are checked by CertChecker
+	//CertChecker skips the principal check when the list is empty
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate has no principals")
+	}
+	ca := keys.FindCa(cert.SignatureKey)
+	if ca == nil {
+		return nil, fmt.Errorf("ca not found")
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return true //matched by FindCa above
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return keys.IsRevoked(ca.Name, cert.Serial)
+		},
+	}
+	perms, err := checker.Authenticate(conn, cert)
+	if err != nil {
+		return nil, err
+	}
+	extensions := make(map[string]string)
+	for n, v := range perms.Extensions {
+		extensions[n] = v
+	}
+	extensions["key-id"] = fmt.Sprintf("%s/%s", ca.Name, cert.KeyId)
+	extensions["ca-id"] = ca.Name
+	return &ssh.Permissions{
+		CriticalOptions: perms.CriticalOptions,
+		Extensions:      extensions,
+	}, nil
+}
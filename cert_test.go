@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type certsDao struct {
+	Dao
+	cas     []*CaDro
+	revoked []*RevokeDro
+}
+
+func (dao *certsDao) EnabledKeys() []*KeyDro {
+	return nil
+}
+
+func (dao *certsDao) AllGrants() []*GrantDro {
+	return nil
+}
+
+func (dao *certsDao) EnabledCas() []*CaDro {
+	return dao.cas
+}
+
+func (dao *certsDao) AllRevoked() []*RevokeDro {
+	return dao.revoked
+}
+
+type certsConn struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (conn *certsConn) User() string {
+	return conn.user
+}
+
+func certsSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestCertAuth(t *testing.T) {
+	ca := certsSigner(t)
+	other := certsSigner(t)
+	user := certsSigner(t)
+	dao := &certsDao{
+		cas: []*CaDro{{Name: "c1", Enabled: true,
+			Key: string(ssh.MarshalAuthorizedKey(ca.PublicKey()))}},
+		revoked: []*RevokeDro{{Ca: "c1", Serial: 66}},
+	}
+	keys := NewKeys(dao)
+	now := uint64(time.Now().Unix())
+	cases := []struct {
+		name   string
+		signer ssh.Signer
+		edit   func(cert *ssh.Certificate)
+		fails  string
+	}{
+		{"valid", ca, func(cert *ssh.Certificate) {}, ""},
+		{"forever", ca, func(cert *ssh.Certificate) {
+			cert.ValidAfter = 0
+			cert.ValidBefore = ssh.CertTimeInfinity
+		}, ""},
+		{"expired", ca, func(cert *ssh.Certificate) {
+			cert.ValidAfter = now - 7200
+			cert.ValidBefore = now - 3600
+		}, "expired"},
+		{"not yet valid", ca, func(cert *ssh.Certificate) {
+			cert.ValidAfter = now + 3600
+		}, "not yet valid"},
+		{"revoked", ca, func(cert *ssh.Certificate) {
+			cert.Serial = 66
+		}, "revoked"},
+		{"revoked by other ca", other, func(cert *ssh.Certificate) {
+			cert.Serial = 66
+		}, "ca not found"},
+		{"wrong principal", ca, func(cert *ssh.Certificate) {
+			cert.ValidPrincipals = []string{"other"}
+		}, "not in the set of valid principals"},
+		{"no principals", ca, func(cert *ssh.Certificate) {
+			cert.ValidPrincipals = nil
+		}, "no principals"},
+		{"unknown ca", other, func(cert *ssh.Certificate) {}, "ca not found"},
+		{"host certificate", ca, func(cert *ssh.Certificate) {
+			cert.CertType = ssh.HostCert
+		}, "cert has type 2"},
+		{"source address", ca, func(cert *ssh.Certificate) {
+			cert.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8"}
+		}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				Key:             user.PublicKey(),
+				Serial:          44,
+				CertType:        ssh.UserCert,
+				KeyId:           "dev1",
+				ValidPrincipals: []string{"sample"},
+				ValidAfter:      now - 60,
+				ValidBefore:     now + 3600,
+			}
+			c.edit(cert)
+			err := cert.SignCert(rand.Reader, c.signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			perms, err := certAuth(keys, &certsConn{user: "sample"}, cert)
+			if len(c.fails) > 0 {
+				if err == nil || !strings.Contains(err.Error(), c.fails) {
+					t.Fatalf("err %v expected %s", err, c.fails)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perms.Extensions["key-id"] != "c1/dev1" || perms.Extensions["ca-id"] != "c1" {
+				t.Fatalf("extensions %v", perms.Extensions)
+			}
+			//the server enforces source-address from the returned options
+			if perms.CriticalOptions["source-address"] != cert.CriticalOptions["source-address"] {
+				t.Fatalf("critical options %v", perms.CriticalOptions)
+			}
+		})
+	}
+}
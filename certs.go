@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type certsDso struct {
+	mutex    *sync.Mutex
+	cert     string
+	key      string
+	ca       string
+	auth     bool
+	modtimes map[string]time.Time
+	config   *tls.Config
+}
+
+type Certs interface {
+	Config(hello *tls.ClientHelloInfo) (*tls.Config, error)
+}
+
+func NewCerts(cert, key, ca string, auth bool) Certs {
+	//files are reloaded on handshake when their mod time changes
+	dso := &certsDso{}
+	dso.mutex = &sync.Mutex{}
+	dso.cert = cert
+	dso.key = key
+	dso.ca = ca
+	dso.auth = auth
+	dso.modtimes = make(map[string]time.Time)
+	err := dso.reload()
+	if err != nil {
+		log.Panicln(err)
+	}
+	return dso
+}
+
+func (dso *certsDso) Config(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	err := dso.reload()
+	if err != nil {
+		log.Println("keeping previous certificates", err)
+	}
+	return dso.config, nil
+}
+
+func (dso *certsDso) changed() (map[string]time.Time, error) {
+	modtimes := make(map[string]time.Time)
+	changed := false
+	for _, path := range []string{dso.cert, dso.key, dso.ca} {
+		if len(path) == 0 {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modtimes[path] = info.ModTime()
+		if !info.ModTime().Equal(dso.modtimes[path]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	return modtimes, nil
+}
+
+func (dso *certsDso) reload() error {
+	//mod times are kept only after a successful load
+	//to retry files caught in the middle of an update
+	modtimes, err := dso.changed()
+	if err != nil || modtimes == nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(dso.cert, dso.key)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if len(dso.ca) > 0 {
+		pem, err := os.ReadFile(dso.ca)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", dso.ca)
+		}
+		config.ClientCAs = pool
+		//tokens remain valid when api auth is enabled
+		if dso.auth {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		} else {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	dso.config = config
+	dso.modtimes = modtimes
+	log.Println("certificates loaded", dso.cert)
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/samuelventura/go-tree"
+)
+
+func cluster(node tree.Node) {
+	dao := node.GetValue("dao").(Dao)
+	ships := node.GetValue("ships").(Ships)
+	hostname := node.GetValue("hostname").(string)
+	lease := time.Duration(node.GetValue("lease").(int64)) * time.Second
+	//rows from a previous run of this host only
+	dao.ClearShips(hostname)
+	epoch := dao.StartHost(hostname, lease)
+	log.Println("host", hostname, "epoch", epoch)
+	node.AddProcess("heartbeat", func() {
+		for {
+			timer := time.NewTimer(lease / 3)
+			select {
+			case <-timer.C:
+			case <-node.Closed():
+				timer.Stop()
+				return
+			}
+			if !dao.Heartbeat(hostname, epoch, lease) {
+				//lease expired and was reaped by another instance
+				log.Println("host fenced", hostname, "epoch", epoch)
+				ships.Close()
+				dao.ClearShips(hostname)
+				epoch = dao.StartHost(hostname, lease)
+				log.Println("host", hostname, "epoch", epoch)
+				continue
+			}
+			for _, host := range dao.ReapHosts(hostname) {
+				log.Println("host reaped", host)
+			}
+			for _, dro := range dao.EvictedShips(hostname) {
+				ship := ships.Get(dro.Ship)
+				if ship != nil && ship.Name() == dro.Sid {
+					log.Println(dro.Ship, "evicted")
+					ship.Close()
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func isConnect(line string) bool {
+	return strings.HasPrefix(line, "CONNECT ")
+}
+
+func connectRequest(conn net.Conn, line string) (string, string, error) {
+	//returns the address and the proxy authorization header
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		connectReply(conn, 400, "Bad Request")
+		return "", "", fmt.Errorf("connect invalid request %q", line)
+	}
+	addr := parts[1]
+	_, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		connectReply(conn, 400, "Bad Request")
+		return "", "", err
+	}
+	//other headers are ignored up to the empty line
+	auth := ""
+	for {
+		ba := make([]byte, 1)
+		_, err := io.ReadFull(conn, ba)
+		if err != nil {
+			return "", "", err
+		}
+		header, err := readLine(conn, ba[0])
+		if err != nil {
+			return "", "", err
+		}
+		if len(header) == 0 {
+			break
+		}
+		fields := strings.SplitN(header, ":", 2)
+		if len(fields) == 2 && strings.EqualFold(strings.TrimSpace(fields[0]), "Proxy-Authorization") {
+			auth = strings.TrimSpace(fields[1])
+		}
+	}
+	return addr, auth, nil
+}
+
+func connectReply(conn net.Conn, code int, status string) error {
+	header := ""
+	if code == 407 {
+		header = "Proxy-Authenticate: Basic realm=\"dock\"\r\n"
+	}
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%s\r\n", code, status, header)
+	return err
+}
+
+func connectStatus(err error) (int, string) {
+	if err == nil {
+		return 200, "Connection established"
+	}
+	if errors.Is(err, errForwardTimeout) {
+		return 504, "Gateway Timeout"
+	}
+	if errors.Is(err, errPolicyDenied) {
+		return 403, "Forbidden"
+	}
+	if errors.Is(err, errConsumerDenied) {
+		return 407, "Proxy Authentication Required"
+	}
+	if errors.Is(err, errInvalidDestination) {
+		return 400, "Bad Request"
+	}
+	var oce *ssh.OpenChannelError
+	if errors.As(err, &oce) && oce.Reason == ssh.ConnectionFailed {
+		msg := strings.ToLower(oce.Message)
+		if strings.Contains(msg, "timeout") ||
+			strings.Contains(msg, "timed out") {
+			return 504, "Gateway Timeout"
+		}
+	}
+	return 502, "Bad Gateway"
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/samuelventura/go-tree"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	consumerNone     = ""
+	consumerPassword = "password"
+	consumerToken    = "token"
+	consumerTls      = "tls"
+)
+
+var errConsumerDenied = errors.New("consumer not authorized")
+
+func validConsumerMode(mode string) bool {
+	switch mode {
+	case consumerNone, consumerPassword, consumerToken, consumerTls:
+		return true
+	}
+	return false
+}
+
+func hashSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func consumerEnabled(dao Dao, ship, name string) (*ConsumerDro, error) {
+	dro, err := dao.GetConsumer(ship, name)
+	if err != nil || !dro.Enabled {
+		return nil, errConsumerDenied
+	}
+	return dro, nil
+}
+
+func consumerAuth(dao Dao, ship, name, secret string) error {
+	dro, err := consumerEnabled(dao, ship, name)
+	if err != nil {
+		return err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(dro.Secret), []byte(secret))
+	if err != nil {
+		return errConsumerDenied
+	}
+	return nil
+}
+
+func NewConsumerCerts(cert, key, ca string) Certs {
+	//nil when tls consumers are not configured
+	if len(cert) == 0 {
+		return nil
+	}
+	return NewCerts(cert, key, ca, false)
+}
+
+func consumerTlsHandshake(node tree.Node, conn net.Conn) (net.Conn, string, error) {
+	//the certificate common name is the consumer name
+	certs, ok := node.GetValue("consumercerts").(Certs)
+	if !ok {
+		return nil, "", fmt.Errorf("consumer tls not configured")
+	}
+	tlsConn := tls.Server(conn, &tls.Config{GetConfigForClient: certs.Config})
+	err := tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return nil, "", err
+	}
+	err = tlsConn.Handshake()
+	if err != nil {
+		return nil, "", err
+	}
+	err = tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, "", err
+	}
+	peers := tlsConn.ConnectionState().PeerCertificates
+	if len(peers) == 0 {
+		return nil, "", errConsumerDenied
+	}
+	return tlsConn, peers[0].Subject.CommonName, nil
+}
+
+func basicAuth(header string) (string, string, bool) {
+	//Proxy-Authorization: Basic base64(name:secret)
+	fields := strings.SplitN(header, " ", 2)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return "", "", false
+	}
+	creds := strings.SplitN(string(decoded), ":", 2)
+	if len(creds) != 2 {
+		return "", "", false
+	}
+	return creds[0], creds[1], true
+}
+
+func tokenLine(line string) (string, string, string, bool) {
+	//name:secret host:port
+	parts := strings.Fields(line)
+	if len(parts) != 2 {
+		return "", "", "", false
+	}
+	creds := strings.SplitN(parts[0], ":", 2)
+	if len(creds) != 2 {
+		return "", "", "", false
+	}
+	return creds[0], creds[1], parts[1], true
+}
+
+func lineConsumer(dao Dao, ship, name, secret string) (string, error) {
+	//gateway lines carry the consumer as a name:secret prefix
+	dro, err := dao.GetShip(ship)
+	if err != nil {
+		return consumerNone, errConsumerDenied
+	}
+	switch dro.Auth {
+	case consumerNone:
+		return dro.Auth, nil
+	case consumerPassword, consumerToken:
+		return dro.Auth, consumerAuth(dao, ship, name, secret)
+	}
+	return dro.Auth, errConsumerDenied
+}
+
+func peerConsumer(dao Dao, ship, name string) (string, error) {
+	//the relaying instance already checked the secret
+	dro, err := dao.GetShip(ship)
+	if err != nil {
+		return consumerNone, errConsumerDenied
+	}
+	switch dro.Auth {
+	case consumerNone:
+		return dro.Auth, nil
+	case consumerPassword, consumerToken:
+		_, err = consumerEnabled(dao, ship, name)
+		return dro.Auth, err
+	}
+	return dro.Auth, errConsumerDenied
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,12 +12,15 @@ import (
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
 type daoDso struct {
-	mutex *sync.Mutex
-	db    *gorm.DB
+	mutex   *sync.Mutex
+	db      *gorm.DB
+	minPort int
+	maxPort int
 }
 
 type Dao interface {
@@ -26,17 +31,82 @@ type Dao interface {
 	AddKey(name, key string) error
 	DelKey(name string) error
 	EnableKey(name string, enabled bool) error
-	ShipStart(sid, ship, key, host, ip string, port int)
+	RoleKey(name, role string) error
+	ListGrants(key string) []*GrantDro
+	AllGrants() []*GrantDro
+	AddGrant(key, ship string) error
+	DelGrant(key, ship string) error
+	ListCas() []*CaDro
+	EnabledCas() []*CaDro
+	GetCa(name string) (*CaDro, error)
+	AddCa(name, key string) error
+	DelCa(name string) error
+	EnableCa(name string, enabled bool) error
+	ListRevoked(ca string) []*RevokeDro
+	AllRevoked() []*RevokeDro
+	RevokeSerial(ca string, serial uint64) error
+	UnrevokeSerial(ca string, serial uint64) error
+	ShipStart(sid, ship, key, host, ip string, port int, path string)
 	ShipStop(sid, ship, key, host, ip string, port int)
 	ShipState(ship string) (*StateDro, error)
-	ClearShips()
+	ListLogs(filter *LogFilter) []*LogDro
+	AddAudit(sid, event, ship, key, consumer, host, addr string)
+	FindLogs(event string, sids []string) []*LogDro
+	AddUsage(ship, key string, when time.Time, in, out, connections int64, duration time.Duration)
+	ShipUsage(ship string, from, to time.Time) []*UsageDro
+	ListTokens() []*TokenDro
+	GetToken(name string) (*TokenDro, error)
+	FindToken(token string) (*TokenDro, error)
+	AddToken(name, token, scope string) error
+	DelToken(name string) error
+	EnableToken(name string, enabled bool) error
+	ListHooks() []*HookDro
+	EnabledHooks() []*HookDro
+	GetHook(name string) (*HookDro, error)
+	AddHook(name, url, secret string) error
+	DelHook(name string) error
+	EnableHook(name string, enabled bool) error
+	AddOutbox(hook, host, event, payload string)
+	DueOutbox(host string, now time.Time, limit int) []*OutboxDro
+	UpdateOutbox(id uint, attempts int, next time.Time, done bool)
+	AddDelivery(dro *DeliveryDro)
+	ListDeliveries(hook string, limit int) []*DeliveryDro
+	ListAcls() []*AclDro
+	AddAcl(scope, name, action, cidr string) (*AclDro, error)
+	DelAcl(id uint) error
+	ListPolicies(ship string) []*PolicyDro
+	AddPolicy(ship, host, ports string) (*PolicyDro, error)
+	DelPolicy(id uint) error
+	AddBan(ip, reason string, until time.Time)
+	ListBans(now time.Time) []*BanDro
+	DelBan(ip string) error
+	ClearBans() int64
+	UseNonce(nonce string, until time.Time) bool
+	ClearShips(host string)
+	StartHost(host string, lease time.Duration) int64
+	Heartbeat(host string, epoch int64, lease time.Duration) bool
+	ReapHosts(reaper string) []string
+	EvictShip(ship string) error
+	EvictedShips(host string) []*StateDro
 	CountShips() int64
 	CountEnabledShips() int64
 	CountDisabledShips() int64
+	ListShips() []*ShipDro
+	Import(doc *BulkDoc, dry bool) error
+	Export() *BulkDoc
 	AddShip(name string) error
 	GetShip(name string) (*ShipDro, error)
 	EnableShip(name string, enabled bool) error
 	PortShip(name string, port int) error
+	AuthShip(name, mode string) error
+	ListConsumers(ship string) []*ConsumerDro
+	GetConsumer(ship, name string) (*ConsumerDro, error)
+	AddConsumer(ship, name, secret string) error
+	DelConsumer(ship, name string) error
+	EnableConsumer(ship, name string, enabled bool) error
+	ReclaimPorts() ([]*ShipDro, error)
+	PortPool() (int, int)
+	PortOwners(min, max int) map[int]string
 }
 
 func dialector(node tree.Node) gorm.Dialector {
@@ -60,11 +130,90 @@ func NewDao(node tree.Node) Dao {
 	if err != nil {
 		log.Panicln(err)
 	}
-	err = db.AutoMigrate(&KeyDro{}, &ShipDro{}, &StateDro{}, &LogDro{})
+	//first run with grants, keys keep the ships they docked before
+	backfill := db.Migrator().HasTable(&KeyDro{}) && !db.Migrator().HasTable(&GrantDro{})
+	err = db.AutoMigrate(&KeyDro{}, &ShipDro{}, &StateDro{}, &LogDro{},
+		&CaDro{}, &RevokeDro{}, &GrantDro{}, &TokenDro{}, &UsageDro{}, &HostDro{},
+		&HookDro{}, &OutboxDro{}, &DeliveryDro{}, &BanDro{}, &AclDro{}, &PolicyDro{}, &ConsumerDro{},
+		&NonceDro{})
 	if err != nil {
 		log.Panicln(err)
 	}
-	return &daoDso{&sync.Mutex{}, db}
+	if backfill {
+		count, err := backfillGrants(db)
+		if err != nil {
+			log.Panicln(err)
+		}
+		log.Println("backfilled grants", count)
+	}
+	//empty range disables the port pool
+	minPort, maxPort, err := parsePortRange(node.GetValue("portrange").(string))
+	if err != nil {
+		log.Panicln(err)
+	}
+	return &daoDso{&sync.Mutex{}, db, minPort, maxPort}
+}
+
+func backfillGrants(db *gorm.DB) (int64, error) {
+	//docking log pairs of keys that still exist
+	grants := []*GrantDro{}
+	result := db.Model(&LogDro{}).Distinct("key", "ship").
+		Where("event = ? and key in (?)", "add", db.Model(&KeyDro{}).Select("name")).
+		Find(&grants)
+	if result.Error != nil || len(grants) == 0 {
+		return 0, result.Error
+	}
+	result = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&grants)
+	return result.RowsAffected, result.Error
+}
+
+func parsePortRange(text string) (int, int, error) {
+	if len(text) == 0 {
+		return 0, 0, nil
+	}
+	parts := strings.Split(text, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %s", text)
+	}
+	min, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if min == 0 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %s", text)
+	}
+	return int(min), int(max), nil
+}
+
+func (dso *daoDso) allocPort(tx *gorm.DB, name string) error {
+	//lowest free port, the unique index catches concurrent instances
+	if dso.minPort == 0 {
+		return nil
+	}
+	ports := []int{}
+	result := tx.Model(&ShipDro{}).
+		Where("port >= ? and port <= ?", dso.minPort, dso.maxPort).
+		Order("port").Pluck("port", &ports)
+	if result.Error != nil {
+		return result.Error
+	}
+	port := dso.minPort
+	for _, used := range ports {
+		if used != port {
+			break
+		}
+		port++
+	}
+	if port > dso.maxPort {
+		return fmt.Errorf("port pool exhausted")
+	}
+	result = tx.Model(&ShipDro{}).
+		Where("name = ? and port = 0", name).Update("port", port)
+	return result.Error
 }
 
 func (dso *daoDso) Close() error {
@@ -81,14 +230,225 @@ func (dso *daoDso) Close() error {
 	return nil
 }
 
-func (dso *daoDso) ClearShips() {
+func (dso *daoDso) ListAcls() []*AclDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*AclDro{}
+	result := dso.db.Order("scope, name, id").Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) AddAcl(scope, name, action, cidr string) (*AclDro, error) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &AclDro{Scope: scope, Name: name, Action: action, Cidr: cidr}
+	result := dso.db.Create(dro)
+	return dro, result.Error
+}
+
+func (dso *daoDso) DelAcl(id uint) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Where("id = ?", id).Delete(&AclDro{})
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("acl not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) ListPolicies(ship string) []*PolicyDro {
+	//empty ship lists all
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*PolicyDro{}
+	query := dso.db.Order("ship, id")
+	if len(ship) > 0 {
+		query = query.Where("ship = ?", ship)
+	}
+	result := query.Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) AddPolicy(ship, host, ports string) (*PolicyDro, error) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &PolicyDro{Ship: ship, Host: host, Ports: ports}
+	result := dso.db.Create(dro)
+	return dro, result.Error
+}
+
+func (dso *daoDso) DelPolicy(id uint) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Where("id = ?", id).Delete(&PolicyDro{})
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("policy not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) AddBan(ip, reason string, until time.Time) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &BanDro{IP: ip, Reason: reason, Until: until, Wts: time.Now()}
+	result := dso.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "ip"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason", "until", "wts"}),
+	}).Create(dro)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+}
+
+func (dso *daoDso) ListBans(now time.Time) []*BanDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*BanDro{}
+	result := dso.db.Where("until > ?", now).Order("ip").Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) DelBan(ip string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Where("ip = ?", ip).Delete(&BanDro{})
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("ban not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) ClearBans() int64 {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Where("1 = 1").Delete(&BanDro{})
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return result.RowsAffected
+}
+
+func (dso *daoDso) UseNonce(nonce string, until time.Time) bool {
+	//shared by all instances, false when already used
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Where("until < ?", time.Now()).Delete(&NonceDro{})
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	dro := &NonceDro{Nonce: nonce, Until: until}
+	result = dso.db.Clauses(clause.OnConflict{DoNothing: true}).Create(dro)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return result.RowsAffected == 1
+}
+
+func (dso *daoDso) ClearShips(host string) {
 	dso.mutex.Lock()
 	defer dso.mutex.Unlock()
 	dro := &StateDro{}
-	result := dso.db.Delete(dro, "true")
+	result := dso.db.Where("host = ?", host).Delete(dro)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+}
+
+func (dso *daoDso) StartHost(host string, lease time.Duration) int64 {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &HostDro{}
+	result := dso.db.Where("host = ?", host).Limit(1).Find(dro)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	dro.Host = host
+	dro.Epoch++
+	dro.Lease = time.Now().Add(lease)
+	result = dso.db.Save(dro)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dro.Epoch
+}
+
+func (dso *daoDso) Heartbeat(host string, epoch int64, lease time.Duration) bool {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Model(&HostDro{}).
+		Where("host = ? and epoch = ?", host, epoch).
+		Update("lease", time.Now().Add(lease))
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return result.RowsAffected == 1
+}
+
+func (dso *daoDso) ReapHosts(reaper string) []string {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*HostDro{}
+	result := dso.db.Where("lease < ?", time.Now()).Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	hosts := []string{}
+	for _, dro := range dros {
+		//guarded by lease to skip hosts that came back meanwhile
+		result = dso.db.
+			Where("host = ? and epoch = ? and lease < ?", dro.Host, dro.Epoch, time.Now()).
+			Delete(&HostDro{})
+		if result.Error != nil {
+			log.Panicln(result.Error)
+		}
+		if result.RowsAffected != 1 {
+			continue
+		}
+		result = dso.db.Where("host = ?", dro.Host).Delete(&StateDro{})
+		if result.Error != nil {
+			log.Panicln(result.Error)
+		}
+		//pending deliveries move to the reaper
+		result = dso.db.Model(&OutboxDro{}).
+			Where("host = ? and done = ?", dro.Host, false).
+			Update("host", reaper)
+		if result.Error != nil {
+			log.Panicln(result.Error)
+		}
+		hosts = append(hosts, dro.Host)
+	}
+	return hosts
+}
+
+func (dso *daoDso) EvictShip(ship string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Model(&StateDro{}).
+		Where("ship = ?", ship).Update("evicted", true)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return fmt.Errorf("ship not docked")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) EvictedShips(host string) []*StateDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*StateDro{}
+	result := dso.db.Where("host = ? and evicted = ?", host, true).Find(&dros)
 	if result.Error != nil {
 		log.Panicln(result.Error)
 	}
+	return dros
 }
 
 func (dso *daoDso) CountShips() int64 {
@@ -124,12 +484,197 @@ func (dso *daoDso) CountDisabledShips() int64 {
 	return count
 }
 
+func (dso *daoDso) ListShips() []*ShipDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*ShipDro{}
+	result := dso.db.Where("true").Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+var errDryRun = fmt.Errorf("dry run")
+
+func (dso *daoDso) Import(doc *BulkDoc, dry bool) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	err := dso.db.Transaction(func(tx *gorm.DB) error {
+		for _, key := range doc.Keys {
+			//grant only rows carry no key
+			if len(key.Key) > 0 {
+				dro := &KeyDro{Name: key.Name, Key: key.Key, Enabled: key.Enabled, Role: key.Role}
+				result := tx.Clauses(clause.OnConflict{
+					Columns:   []clause.Column{{Name: "name"}},
+					DoUpdates: clause.AssignmentColumns([]string{"key", "enabled", "role"}),
+				}).Create(dro)
+				if result.Error != nil {
+					return result.Error
+				}
+			}
+			for _, ship := range key.Ships {
+				dro := &GrantDro{Key: key.Name, Ship: ship}
+				result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(dro)
+				if result.Error != nil {
+					return result.Error
+				}
+			}
+		}
+		for _, ship := range doc.Ships {
+			//port 0 keeps the current port or takes one from the pool
+			columns := []string{"enabled", "auth"}
+			if ship.Port != 0 {
+				columns = append(columns, "port")
+			}
+			dro := &ShipDro{Name: ship.Name, Port: ship.Port, Enabled: ship.Enabled, Auth: ship.Auth}
+			result := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "name"}},
+				DoUpdates: clause.AssignmentColumns(columns),
+			}).Create(dro)
+			if result.Error != nil {
+				return result.Error
+			}
+			err := dso.allocPort(tx, ship.Name)
+			if err != nil {
+				return err
+			}
+		}
+		for _, ca := range doc.Cas {
+			dro := &CaDro{Name: ca.Name, Key: ca.Key, Enabled: ca.Enabled}
+			result := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "name"}},
+				DoUpdates: clause.AssignmentColumns([]string{"key", "enabled"}),
+			}).Create(dro)
+			if result.Error != nil {
+				return result.Error
+			}
+			for _, serial := range ca.Revoked {
+				dro := &RevokeDro{Ca: ca.Name, Serial: serial}
+				result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(dro)
+				if result.Error != nil {
+					return result.Error
+				}
+			}
+		}
+		for _, acl := range doc.Acls {
+			//rules have no natural key, identical rules are skipped
+			count := int64(0)
+			result := tx.Model(&AclDro{}).
+				Where("scope = ? and name = ? and action = ? and cidr = ?",
+					acl.Scope, acl.Name, acl.Action, acl.Cidr).Count(&count)
+			if result.Error != nil {
+				return result.Error
+			}
+			if count > 0 {
+				continue
+			}
+			dro := &AclDro{Scope: acl.Scope, Name: acl.Name, Action: acl.Action, Cidr: acl.Cidr}
+			result = tx.Create(dro)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		for _, policy := range doc.Policies {
+			count := int64(0)
+			result := tx.Model(&PolicyDro{}).
+				Where("ship = ? and host = ? and ports = ?",
+					policy.Ship, policy.Host, policy.Ports).Count(&count)
+			if result.Error != nil {
+				return result.Error
+			}
+			if count > 0 {
+				continue
+			}
+			dro := &PolicyDro{Ship: policy.Ship, Host: policy.Host, Ports: policy.Ports}
+			result = tx.Create(dro)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		if dry {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		return nil
+	}
+	return err
+}
+
+func (dso *daoDso) Export() *BulkDoc {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	doc := &BulkDoc{}
+	keys := []*KeyDro{}
+	grants := []*GrantDro{}
+	ships := []*ShipDro{}
+	cas := []*CaDro{}
+	revoked := []*RevokeDro{}
+	acls := []*AclDro{}
+	policies := []*PolicyDro{}
+	for _, find := range []func() *gorm.DB{
+		func() *gorm.DB { return dso.db.Order("name").Find(&keys) },
+		func() *gorm.DB { return dso.db.Order("key, ship").Find(&grants) },
+		func() *gorm.DB { return dso.db.Order("name").Find(&ships) },
+		func() *gorm.DB { return dso.db.Order("name").Find(&cas) },
+		func() *gorm.DB { return dso.db.Order("ca, serial").Find(&revoked) },
+		func() *gorm.DB { return dso.db.Order("scope, name, id").Find(&acls) },
+		func() *gorm.DB { return dso.db.Order("ship, id").Find(&policies) },
+	} {
+		result := find()
+		if result.Error != nil {
+			log.Panicln(result.Error)
+		}
+	}
+	keyShips := make(map[string][]string)
+	for _, dro := range grants {
+		keyShips[dro.Key] = append(keyShips[dro.Key], dro.Ship)
+	}
+	for _, dro := range keys {
+		doc.Keys = append(doc.Keys, &BulkKey{Name: dro.Name, Key: dro.Key,
+			Enabled: dro.Enabled, Role: dro.Role, Ships: keyShips[dro.Name]})
+		delete(keyShips, dro.Name)
+	}
+	//grants may outlive their key
+	for key, ships := range keyShips {
+		doc.Keys = append(doc.Keys, &BulkKey{Name: key, Ships: ships})
+	}
+	for _, dro := range ships {
+		doc.Ships = append(doc.Ships, &BulkShip{Name: dro.Name, Port: dro.Port,
+			Enabled: dro.Enabled, Auth: dro.Auth})
+	}
+	caSerials := make(map[string][]uint64)
+	for _, dro := range revoked {
+		caSerials[dro.Ca] = append(caSerials[dro.Ca], dro.Serial)
+	}
+	for _, dro := range cas {
+		doc.Cas = append(doc.Cas, &BulkCa{Name: dro.Name, Key: dro.Key,
+			Enabled: dro.Enabled, Revoked: caSerials[dro.Name]})
+	}
+	for _, dro := range acls {
+		doc.Acls = append(doc.Acls, &BulkAcl{Scope: dro.Scope, Name: dro.Name,
+			Action: dro.Action, Cidr: dro.Cidr})
+	}
+	for _, dro := range policies {
+		doc.Policies = append(doc.Policies, &BulkPolicy{Ship: dro.Ship, Host: dro.Host,
+			Ports: dro.Ports})
+	}
+	return doc
+}
+
 func (dso *daoDso) AddShip(name string) error {
 	dso.mutex.Lock()
 	defer dso.mutex.Unlock()
-	dro := &ShipDro{Name: name}
-	result := dso.db.Create(dro)
-	return result.Error
+	return dso.db.Transaction(func(tx *gorm.DB) error {
+		dro := &ShipDro{Name: name}
+		result := tx.Create(dro)
+		if result.Error != nil {
+			return result.Error
+		}
+		return dso.allocPort(tx, name)
+	})
 }
 
 func (dso *daoDso) GetShip(name string) (*ShipDro, error) {
@@ -143,27 +688,154 @@ func (dso *daoDso) GetShip(name string) (*ShipDro, error) {
 }
 
 func (dso *daoDso) EnableShip(name string, enabled bool) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	return dso.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&ShipDro{}).
+			Where("name = ?", name).Update("enabled", enabled)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return fmt.Errorf("ship not found")
+		}
+		//reclaimed ships get a port back
+		if enabled {
+			return dso.allocPort(tx, name)
+		}
+		return nil
+	})
+}
+
+func (dso *daoDso) PortShip(name string, port int) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	return dso.db.Transaction(func(tx *gorm.DB) error {
+		if port != 0 {
+			dro := &ShipDro{}
+			result := tx.Where("port = ? and name <> ?", port, name).Limit(1).Find(dro)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected > 0 {
+				return fmt.Errorf("port %d taken by %s", port, dro.Name)
+			}
+		}
+		result := tx.Model(&ShipDro{}).
+			Where("name = ?", name).Update("port", port)
+		if result.Error == nil && result.RowsAffected != 1 {
+			return fmt.Errorf("ship not found")
+		}
+		return result.Error
+	})
+}
+
+func (dso *daoDso) PortPool() (int, int) {
+	return dso.minPort, dso.maxPort
+}
+
+func (dso *daoDso) PortOwners(min, max int) map[int]string {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*ShipDro{}
+	result := dso.db.Where("port >= ? and port <= ?", min, max).Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	owners := make(map[int]string)
+	for _, dro := range dros {
+		owners[dro.Port] = dro.Name
+	}
+	return owners
+}
+
+func (dso *daoDso) AuthShip(name, mode string) error {
 	dso.mutex.Lock()
 	defer dso.mutex.Unlock()
 	result := dso.db.Model(&ShipDro{}).
-		Where("name = ?", name).Update("enabled", enabled)
+		Where("name = ?", name).Update("auth", mode)
 	if result.Error == nil && result.RowsAffected != 1 {
 		return fmt.Errorf("ship not found")
 	}
 	return result.Error
 }
 
-func (dso *daoDso) PortShip(name string, port int) error {
+func (dso *daoDso) ListConsumers(ship string) []*ConsumerDro {
 	dso.mutex.Lock()
 	defer dso.mutex.Unlock()
-	result := dso.db.Model(&ShipDro{}).
-		Where("name = ?", name).Update("port", port)
+	dros := []*ConsumerDro{}
+	result := dso.db.Where("ship = ?", ship).Order("name").Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) GetConsumer(ship, name string) (*ConsumerDro, error) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &ConsumerDro{}
+	result := dso.db.
+		Where("ship = ? and name = ?", ship, name).
+		First(dro)
+	return dro, result.Error
+}
+
+func (dso *daoDso) AddConsumer(ship, name, secret string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &ConsumerDro{Ship: ship, Name: name, Secret: secret, Enabled: true}
+	result := dso.db.Create(dro)
+	return result.Error
+}
+
+func (dso *daoDso) DelConsumer(ship, name string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Where("ship = ? and name = ?", ship, name).Delete(&ConsumerDro{})
 	if result.Error == nil && result.RowsAffected != 1 {
-		return fmt.Errorf("ship not found")
+		return fmt.Errorf("consumer not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) EnableConsumer(ship, name string, enabled bool) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Model(&ConsumerDro{}).
+		Where("ship = ? and name = ?", ship, name).Update("enabled", enabled)
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("consumer not found")
 	}
 	return result.Error
 }
 
+func (dso *daoDso) ReclaimPorts() ([]*ShipDro, error) {
+	//disabled ships release their pool ports
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	if dso.minPort == 0 {
+		return nil, fmt.Errorf("port pool not configured")
+	}
+	dros := []*ShipDro{}
+	err := dso.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("enabled = ? and port >= ? and port <= ?",
+			false, dso.minPort, dso.maxPort).Order("name").Find(&dros)
+		if result.Error != nil {
+			return result.Error
+		}
+		for _, dro := range dros {
+			result = tx.Model(&ShipDro{}).
+				Where("name = ?", dro.Name).Update("port", 0)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		return nil
+	})
+	return dros, err
+}
+
 func (dso *daoDso) EnabledKeys() []*KeyDro {
 	dso.mutex.Lock()
 	defer dso.mutex.Unlock()
@@ -214,6 +886,12 @@ func (dso *daoDso) DelKey(name string) error {
 	if result.Error == nil && result.RowsAffected != 1 {
 		return fmt.Errorf("key not found")
 	}
+	if result.Error != nil {
+		return result.Error
+	}
+	result = dso.db.
+		Where("key = ?", name).
+		Delete(&GrantDro{})
 	return result.Error
 }
 
@@ -228,35 +906,396 @@ func (dso *daoDso) EnableKey(name string, enabled bool) error {
 	return result.Error
 }
 
-func (dso *daoDso) ShipState(ship string) (*StateDro, error) {
+func (dso *daoDso) RoleKey(name, role string) error {
 	dso.mutex.Lock()
 	defer dso.mutex.Unlock()
-	dro := &StateDro{}
-	result := dso.db.
-		Where("ship = ?", ship).
-		Order("wts desc").
-		First(dro)
-	return dro, result.Error
+	result := dso.db.Model(&KeyDro{}).
+		Where("name = ?", name).Update("role", role)
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("key not found")
+	}
+	return result.Error
 }
 
-func (dso *daoDso) ShipStart(sid, ship, key, host, ip string, port int) {
+func (dso *daoDso) ListGrants(key string) []*GrantDro {
 	dso.mutex.Lock()
 	defer dso.mutex.Unlock()
-	err := dso.addEvent(sid, "add", ship, key, host, ip, port)
-	if err != nil {
-		log.Panicln(err)
+	dros := []*GrantDro{}
+	result := dso.db.Where("key = ?", key).Order("ship").Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
 	}
-	dro := &StateDro{}
-	dro.Sid = sid
-	dro.Wts = time.Now()
-	dro.Ship = ship
-	dro.Port = port
+	return dros
+}
+
+func (dso *daoDso) AllGrants() []*GrantDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*GrantDro{}
+	result := dso.db.Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) AddGrant(key, ship string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &GrantDro{Key: key, Ship: ship}
+	result := dso.db.Create(dro)
+	return result.Error
+}
+
+func (dso *daoDso) DelGrant(key, ship string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &GrantDro{}
+	result := dso.db.
+		Where("key = ? and ship = ?", key, ship).
+		Delete(dro)
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("grant not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) ListCas() []*CaDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*CaDro{}
+	result := dso.db.Where("true").Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) EnabledCas() []*CaDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*CaDro{}
+	result := dso.db.Where("enabled", true).Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) GetCa(name string) (*CaDro, error) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &CaDro{}
+	result := dso.db.
+		Where("name = ?", name).
+		First(dro)
+	return dro, result.Error
+}
+
+func (dso *daoDso) AddCa(name, key string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &CaDro{Name: name, Key: key}
+	result := dso.db.Create(dro)
+	return result.Error
+}
+
+func (dso *daoDso) DelCa(name string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &CaDro{}
+	result := dso.db.
+		Where("name = ?", name).
+		Delete(dro)
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("ca not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) EnableCa(name string, enabled bool) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Model(&CaDro{}).
+		Where("name = ?", name).Update("enabled", enabled)
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("ca not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) ListRevoked(ca string) []*RevokeDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*RevokeDro{}
+	result := dso.db.Where("ca = ?", ca).Order("serial").Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) AllRevoked() []*RevokeDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*RevokeDro{}
+	result := dso.db.Where("true").Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) RevokeSerial(ca string, serial uint64) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &RevokeDro{Ca: ca, Serial: serial}
+	result := dso.db.Create(dro)
+	return result.Error
+}
+
+func (dso *daoDso) UnrevokeSerial(ca string, serial uint64) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &RevokeDro{}
+	result := dso.db.
+		Where("ca = ? and serial = ?", ca, serial).
+		Delete(dro)
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("serial not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) ListTokens() []*TokenDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*TokenDro{}
+	result := dso.db.Where("true").Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) GetToken(name string) (*TokenDro, error) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &TokenDro{}
+	result := dso.db.
+		Where("name = ?", name).
+		First(dro)
+	return dro, result.Error
+}
+
+func (dso *daoDso) FindToken(token string) (*TokenDro, error) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &TokenDro{}
+	result := dso.db.
+		Where("token = ?", token).
+		First(dro)
+	return dro, result.Error
+}
+
+func (dso *daoDso) AddToken(name, token, scope string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &TokenDro{Name: name, Token: token, Scope: scope, Enabled: true}
+	result := dso.db.Create(dro)
+	return result.Error
+}
+
+func (dso *daoDso) DelToken(name string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &TokenDro{}
+	result := dso.db.
+		Where("name = ?", name).
+		Delete(dro)
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("token not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) EnableToken(name string, enabled bool) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Model(&TokenDro{}).
+		Where("name = ?", name).Update("enabled", enabled)
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("token not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) ListHooks() []*HookDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*HookDro{}
+	result := dso.db.Where("true").Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) EnabledHooks() []*HookDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*HookDro{}
+	result := dso.db.Where("enabled", true).Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) GetHook(name string) (*HookDro, error) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &HookDro{}
+	result := dso.db.
+		Where("name = ?", name).
+		First(dro)
+	return dro, result.Error
+}
+
+func (dso *daoDso) AddHook(name, url, secret string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &HookDro{Name: name, Url: url, Secret: secret, Enabled: true}
+	result := dso.db.Create(dro)
+	return result.Error
+}
+
+func (dso *daoDso) DelHook(name string) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &HookDro{}
+	result := dso.db.
+		Where("name = ?", name).
+		Delete(dro)
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("hook not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) EnableHook(name string, enabled bool) error {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Model(&HookDro{}).
+		Where("name = ?", name).Update("enabled", enabled)
+	if result.Error == nil && result.RowsAffected != 1 {
+		return fmt.Errorf("hook not found")
+	}
+	return result.Error
+}
+
+func (dso *daoDso) AddOutbox(hook, host, event, payload string) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &OutboxDro{}
+	dro.Hook = hook
+	dro.Host = host
+	dro.Event = event
+	dro.Payload = payload
+	dro.NextTry = time.Now()
+	result := dso.db.Create(dro)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+}
+
+func (dso *daoDso) DueOutbox(host string, now time.Time, limit int) []*OutboxDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*OutboxDro{}
+	result := dso.db.
+		Where("host = ? and done = ? and next_try <= ?", host, false, now).
+		Order("id").
+		Limit(limit).
+		Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) UpdateOutbox(id uint, attempts int, next time.Time, done bool) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Model(&OutboxDro{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{"attempts": attempts, "next_try": next, "done": done})
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+}
+
+func (dso *daoDso) AddDelivery(dro *DeliveryDro) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	result := dso.db.Create(dro)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+}
+
+func (dso *daoDso) ListDeliveries(hook string, limit int) []*DeliveryDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*DeliveryDro{}
+	result := dso.db.
+		Where("hook = ?", hook).
+		Order("id desc").
+		Limit(limit).
+		Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) ShipState(ship string) (*StateDro, error) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &StateDro{}
+	result := dso.db.
+		Where("ship = ?", ship).
+		Order("wts desc").
+		First(dro)
+	return dro, result.Error
+}
+
+func (dso *daoDso) ShipStart(sid, ship, key, host, ip string, port int, path string) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	err := dso.addEvent(sid, "add", ship, key, host, ip, port)
+	if err != nil {
+		log.Panicln(err)
+	}
+	dro := &StateDro{}
+	dro.Sid = sid
+	dro.Wts = time.Now()
+	dro.Ship = ship
+	dro.Port = port
 	dro.Host = host
 	dro.IP = ip
+	dro.Path = path
 	result := dso.db.Create(dro)
 	if result.Error != nil {
 		log.Panicln(result.Error)
 	}
+	//newest session wins, other instances close theirs
+	result = dso.db.Model(&StateDro{}).
+		Where("ship = ? and host <> ?", ship, host).
+		Update("evicted", true)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
 }
 
 func (dso *daoDso) ShipStop(sid, ship, key, host, ip string, port int) {
@@ -271,8 +1310,122 @@ func (dso *daoDso) ShipStop(sid, ship, key, host, ip string, port int) {
 	if result.Error != nil {
 		log.Panicln(result.Error)
 	}
+	//reaped by another instance while fenced
 	if result.RowsAffected != 1 {
-		log.Panicln("row not found")
+		log.Println(ship, "state not found", sid)
+	}
+}
+
+func (dso *daoDso) AddUsage(ship, key string, when time.Time, in, out, connections int64, duration time.Duration) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &UsageDro{}
+	dro.Ship = ship
+	dro.Key = key
+	dro.Hour = when.UTC().Truncate(time.Hour)
+	dro.BytesIn = in
+	dro.BytesOut = out
+	dro.Connections = connections
+	dro.Millis = duration.Milliseconds()
+	//accumulate into existing hourly bucket
+	result := dso.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "ship"}, {Name: "key"}, {Name: "hour"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"bytes_in":    gorm.Expr("usage_dros.bytes_in + excluded.bytes_in"),
+			"bytes_out":   gorm.Expr("usage_dros.bytes_out + excluded.bytes_out"),
+			"connections": gorm.Expr("usage_dros.connections + excluded.connections"),
+			"millis":      gorm.Expr("usage_dros.millis + excluded.millis"),
+		}),
+	}).Create(dro)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+}
+
+func (dso *daoDso) ShipUsage(ship string, from, to time.Time) []*UsageDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*UsageDro{}
+	result := dso.db.
+		Where("ship = ? and hour >= ? and hour < ?", ship,
+			from.UTC().Truncate(time.Hour), to.UTC()).
+		Order("hour, key").
+		Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) ListLogs(filter *LogFilter) []*LogDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*LogDro{}
+	query := dso.db.Where("true")
+	if len(filter.Ship) > 0 {
+		query = query.Where("ship = ?", filter.Ship)
+	}
+	if len(filter.Key) > 0 {
+		query = query.Where("key = ?", filter.Key)
+	}
+	if len(filter.Host) > 0 {
+		query = query.Where("host = ?", filter.Host)
+	}
+	if len(filter.Event) > 0 {
+		query = query.Where("event = ?", filter.Event)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("wts >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("wts < ?", filter.To)
+	}
+	if filter.Cursor != nil {
+		cursor := filter.Cursor
+		query = query.Where("wts < ? or (wts = ? and sid < ?) or (wts = ? and sid = ? and event < ?)",
+			cursor.Wts, cursor.Wts, cursor.Sid, cursor.Wts, cursor.Sid, cursor.Event)
+	}
+	result := query.
+		Order("wts desc, sid desc, event desc").
+		Limit(filter.Limit).
+		Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) FindLogs(event string, sids []string) []*LogDro {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dros := []*LogDro{}
+	if len(sids) == 0 {
+		return dros
+	}
+	result := dso.db.
+		Where("event = ? and sid in ?", event, sids).
+		Find(&dros)
+	if result.Error != nil {
+		log.Panicln(result.Error)
+	}
+	return dros
+}
+
+func (dso *daoDso) AddAudit(sid, event, ship, key, consumer, host, addr string) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dro := &LogDro{}
+	dro.Sid = sid
+	dro.Event = event
+	dro.Wts = time.Now()
+	dro.Ship = ship
+	dro.Key = key
+	dro.Consumer = consumer
+	dro.Host = host
+	dro.Addr = addr
+	result := dso.db.Create(dro)
+	if result.Error != nil {
+		log.Panicln(result.Error)
 	}
 }
 
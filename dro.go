@@ -6,30 +6,138 @@ type KeyDro struct {
 	Name    string `gorm:"primaryKey"`
 	Key     string
 	Enabled bool
+	Role    string
+}
+
+type GrantDro struct {
+	Key  string `gorm:"primaryKey"`
+	Ship string `gorm:"primaryKey;index"`
+}
+
+type CaDro struct {
+	Name    string `gorm:"primaryKey"`
+	Key     string
+	Enabled bool
+}
+
+type RevokeDro struct {
+	Ca     string `gorm:"primaryKey"`
+	Serial uint64 `gorm:"primaryKey;autoIncrement:false"`
+}
+
+type TokenDro struct {
+	Name    string `gorm:"primaryKey"`
+	Token   string `gorm:"uniqueIndex" json:"-"`
+	Scope   string
+	Enabled bool
 }
 
 type ShipDro struct {
 	Name    string `gorm:"primaryKey"`
-	Port    int
+	Port    int    `gorm:"uniqueIndex:idx_ship_port,where:port <> 0"`
+	Enabled bool
+	Auth    string
+}
+
+type ConsumerDro struct {
+	Ship    string `gorm:"primaryKey"`
+	Name    string `gorm:"primaryKey"`
+	Secret  string `json:"-"`
 	Enabled bool
 }
 
 type StateDro struct {
-	Sid  string `gorm:"primaryKey"`
-	Port int
-	Ship string `gorm:"index"`
-	Wts  time.Time
-	Host string
-	IP   string
+	Sid     string `gorm:"primaryKey"`
+	Port    int
+	Ship    string `gorm:"index"`
+	Wts     time.Time
+	Host    string `gorm:"index"`
+	IP      string
+	Path    string
+	Evicted bool
 }
 
-type LogDro struct {
-	Sid   string
-	Event string
-	Port  int
-	Ship  string
-	Key   string
-	Wts   time.Time
+type AclDro struct {
+	ID     uint   `gorm:"primaryKey"`
+	Scope  string `gorm:"index:idx_acl_scope"`
+	Name   string `gorm:"index:idx_acl_scope"`
+	Action string
+	Cidr   string
+}
+
+type PolicyDro struct {
+	ID    uint   `gorm:"primaryKey"`
+	Ship  string `gorm:"index"`
 	Host  string
-	IP    string
+	Ports string
+}
+
+type BanDro struct {
+	IP     string `gorm:"primaryKey"`
+	Reason string
+	Until  time.Time `gorm:"index"`
+	Wts    time.Time
+}
+
+type NonceDro struct {
+	Nonce string    `gorm:"primaryKey"`
+	Until time.Time `gorm:"index"`
+}
+
+type HostDro struct {
+	Host  string `gorm:"primaryKey"`
+	Epoch int64
+	Lease time.Time
+}
+
+type UsageDro struct {
+	Ship        string    `gorm:"primaryKey"`
+	Key         string    `gorm:"primaryKey"`
+	Hour        time.Time `gorm:"primaryKey"`
+	BytesIn     int64
+	BytesOut    int64
+	Connections int64
+	Millis      int64
+}
+
+type HookDro struct {
+	Name    string `gorm:"primaryKey"`
+	Url     string
+	Secret  string `json:"-"`
+	Enabled bool
+}
+
+type OutboxDro struct {
+	ID       uint `gorm:"primaryKey"`
+	Hook     string
+	Host     string `gorm:"index"`
+	Event    string
+	Payload  string
+	Attempts int
+	NextTry  time.Time `gorm:"index"`
+	Done     bool      `gorm:"index"`
+}
+
+type DeliveryDro struct {
+	ID      uint `gorm:"primaryKey"`
+	Outbox  uint
+	Hook    string `gorm:"index"`
+	Event   string
+	Wts     time.Time
+	Attempt int
+	Status  int
+	Error   string
+}
+
+type LogDro struct {
+	Sid      string `gorm:"index:idx_log_order,priority:2"`
+	Event    string `gorm:"index:idx_log_order,priority:3"`
+	Port     int
+	Ship     string `gorm:"index"`
+	Key      string
+	Wts      time.Time `gorm:"index:idx_log_order,priority:1"`
+	Host     string
+	IP       string
+	Addr     string
+	Consumer string
 }
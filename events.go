@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type Event struct {
+	Type   string
+	Ship   string
+	Sid    string
+	Key    string
+	Host   string
+	Detail string
+	Wts    time.Time
+}
+
+type eventsDso struct {
+	mutex    *sync.Mutex
+	next     int
+	subs     map[int]*eventsSub
+	handlers []func(event *Event)
+}
+
+type eventsSub struct {
+	ship    string
+	channel chan *Event
+}
+
+type Events interface {
+	Publish(event *Event)
+	Subscribe(ship string) (int, <-chan *Event)
+	Unsubscribe(id int)
+	Handle(handler func(event *Event))
+}
+
+func NewEvents() Events {
+	dso := &eventsDso{}
+	dso.mutex = &sync.Mutex{}
+	dso.subs = make(map[int]*eventsSub)
+	return dso
+}
+
+func (dso *eventsDso) Publish(event *Event) {
+	//handlers run in the publisher goroutine and never miss events
+	for _, handler := range dso.deliver(event) {
+		handler(event)
+	}
+}
+
+func (dso *eventsDso) deliver(event *Event) []func(event *Event) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	if event.Wts.IsZero() {
+		event.Wts = time.Now()
+	}
+	for _, sub := range dso.subs {
+		if len(sub.ship) > 0 && sub.ship != event.Ship {
+			continue
+		}
+		//slow subscribers miss events instead of blocking publishers
+		select {
+		case sub.channel <- event:
+		default:
+		}
+	}
+	return dso.handlers
+}
+
+func (dso *eventsDso) Subscribe(ship string) (int, <-chan *Event) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.next++
+	sub := &eventsSub{ship, make(chan *Event, 64)}
+	dso.subs[dso.next] = sub
+	return dso.next, sub.channel
+}
+
+func (dso *eventsDso) Unsubscribe(id int) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	delete(dso.subs, id)
+}
+
+func (dso *eventsDso) Handle(handler func(event *Event)) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.handlers = append(dso.handlers, handler)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/samuelventura/go-tree"
+)
+
+type exportOwner struct {
+	uid int
+	gid int
+}
+
+func parseExportMode(text string) os.FileMode {
+	mode, err := strconv.ParseUint(text, 8, 32)
+	if err != nil {
+		log.Panicln("invalid export mode", text, err)
+	}
+	return os.FileMode(mode)
+}
+
+func parseExportOwner(text string) *exportOwner {
+	//user:group by name or id, empty keeps the process owner
+	if len(text) == 0 {
+		return nil
+	}
+	parts := strings.SplitN(text, ":", 2)
+	owner := &exportOwner{uid: -1, gid: -1}
+	if len(parts[0]) > 0 {
+		uid, err := strconv.Atoi(parts[0])
+		if err != nil {
+			u, err := user.Lookup(parts[0])
+			if err != nil {
+				log.Panicln(err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+			if len(parts) == 1 {
+				owner.gid, _ = strconv.Atoi(u.Gid)
+			}
+		}
+		owner.uid = uid
+	}
+	if len(parts) == 2 && len(parts[1]) > 0 {
+		gid, err := strconv.Atoi(parts[1])
+		if err != nil {
+			g, err := user.LookupGroup(parts[1])
+			if err != nil {
+				log.Panicln(err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		owner.gid = gid
+	}
+	return owner
+}
+
+func exportListen(node tree.Node, ship string, port int) (net.Listener, string, int, error) {
+	//returns listener, proxy address and tcp port (0 for unix)
+	dir := node.GetValue("exportunix").(string)
+	if len(dir) == 0 {
+		export := node.GetValue("export").(string)
+		endpoint := fmt.Sprintf("%s:%d", export, port)
+		listen, err := net.Listen("tcp", endpoint)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		port = listen.Addr().(*net.TCPAddr).Port
+		return listen, listen.Addr().String(), port, nil
+	}
+	mode := node.GetValue("exportmode").(os.FileMode)
+	owner := node.GetValue("exportowner").(*exportOwner)
+	if len(ship) == 0 || filepath.Base(ship) != ship || ship == ".." {
+		return nil, "", 0, fmt.Errorf("invalid socket name %s", ship)
+	}
+	path := filepath.Join(dir, ship+".sock")
+	//stale from a crash or held by the session being replaced
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, "", 0, err
+	}
+	listen, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, "", 0, err
+	}
+	listen.SetUnlinkOnClose(false)
+	info, err := os.Stat(path)
+	if err == nil {
+		err = os.Chmod(path, mode)
+	}
+	if err == nil && owner != nil {
+		err = os.Chown(path, owner.uid, owner.gid)
+	}
+	if err != nil {
+		listen.Close()
+		return nil, "", 0, err
+	}
+	return &unixExport{listen, path, info}, path, 0, nil
+}
+
+func exportPath(proxy string, port int) string {
+	if port == 0 {
+		return proxy
+	}
+	return ""
+}
+
+type unixExport struct {
+	*net.UnixListener
+	path string
+	info os.FileInfo
+}
+
+func (ue *unixExport) Close() error {
+	//a replacing session may already own the path
+	err := ue.UnixListener.Close()
+	info, serr := os.Stat(ue.path)
+	if serr == nil && os.SameFile(info, ue.info) {
+		os.Remove(ue.path)
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/samuelventura/go-tree"
+	"golang.org/x/crypto/ssh"
+)
+
+var errForwardTimeout = errors.New("forward timeout")
+
+type forwardResult struct {
+	sshChan ssh.Channel
+	reqChan <-chan *ssh.Request
+	err     error
+}
+
+func openForward(sshConn ssh.Conn, addr string) (ssh.Channel, <-chan *ssh.Request, error) {
+	done := make(chan *forwardResult, 1)
+	go func() {
+		sshChan, reqChan, err := sshConn.OpenChannel("forward", []byte(addr))
+		done <- &forwardResult{sshChan, reqChan, err}
+	}()
+	timer := time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result.sshChan, result.reqChan, result.err
+	case <-timer.C:
+		//late channels get closed as soon as they arrive
+		go func() {
+			result := <-done
+			if result.err == nil {
+				go ssh.DiscardRequests(result.reqChan)
+				result.sshChan.Close()
+			}
+		}()
+		return nil, nil, errForwardTimeout
+	}
+}
+
+func pipeForward(node tree.Node, conn io.ReadWriter, remote string, sshChan ssh.Channel, reqChan <-chan *ssh.Request, ship, key string, tag interface{}) {
+	dao := node.GetValue("dao").(Dao)
+	metrics := node.GetValue("metrics").(Metrics)
+	events := node.GetValue("events").(Events)
+	hostname := node.GetValue("hostname").(string)
+	metrics.ProxyOpened(ship)
+	defer metrics.ProxyClosed(ship)
+	events.Publish(&Event{Type: "proxy-opened", Ship: ship, Sid: node.Name(), Key: key,
+		Host: hostname, Detail: remote})
+	defer events.Publish(&Event{Type: "proxy-closed", Ship: ship, Sid: node.Name(), Key: key,
+		Host: hostname, Detail: remote})
+	start := time.Now()
+	in := &countWriter{writer: sshChan}
+	out := &countWriter{writer: conn}
+	node.AddCloser("sshChan", sshChan.Close)
+	node.AddProcess("DiscardRequests(reqChan)", func() {
+		ssh.DiscardRequests(reqChan)
+	})
+	node.AddProcess("Copy(sshChan, conn)", func() {
+		_, err := io.Copy(in, conn)
+		if err != nil {
+			log.Println(tag, err)
+		}
+	})
+	node.AddProcess("Copy(conn, sshChan)", func() {
+		_, err := io.Copy(out, sshChan)
+		if err != nil {
+			log.Println(tag, err)
+		}
+	})
+	//deltas are flushed at every minute boundary so they land in
+	//the hour they happened, the connection counts in its first hour,
+	//byte metrics are added with the same deltas
+	mutex := &sync.Mutex{}
+	flushed := start
+	flushedIn, flushedOut := int64(0), int64(0)
+	connections := int64(1)
+	flush := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now := time.Now()
+		countIn, countOut := in.Count(), out.Count()
+		metrics.ProxyBytes(ship, "in", countIn-flushedIn)
+		metrics.ProxyBytes(ship, "out", countOut-flushedOut)
+		dao.AddUsage(ship, key, flushed, countIn-flushedIn, countOut-flushedOut,
+			connections, now.Sub(flushed))
+		flushed = now
+		flushedIn, flushedOut = countIn, countOut
+		connections = 0
+	}
+	node.AddProcess("usage", func() {
+		for {
+			timer := time.NewTimer(time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)))
+			select {
+			case <-timer.C:
+				flush()
+			case <-node.Closed():
+				timer.Stop()
+				return
+			}
+		}
+	})
+	node.WaitClosed()
+	flush()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/samuelventura/go-tools"
+	"github.com/samuelventura/go-tree"
+	"golang.org/x/crypto/ssh"
+)
+
+func gateway(node tree.Node) {
+	ships := node.GetValue("ships").(Ships)
+	endpoint := node.GetValue("endpoint").(string)
+	if len(endpoint) == 0 {
+		log.Println("gateway disabled")
+		return
+	}
+	listen, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		log.Panicln(err)
+	}
+	node.AddCloser("listen", listen.Close)
+	port := listen.Addr().(*net.TCPAddr).Port
+	log.Println("port gateway", port)
+	node.AddProcess("listen", func() {
+		id := NewId("gateway-" + listen.Addr().String())
+		for {
+			gatewayConn, err := listen.Accept()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			setupGatewayConnection(node, gatewayConn, ships, id)
+		}
+	})
+}
+
+func setupGatewayConnection(node tree.Node, gatewayConn net.Conn, ships Ships, id Id) {
+	defer node.IfRecoverCloser(gatewayConn.Close)
+	addr := gatewayConn.RemoteAddr().String()
+	cid := id.Next(addr)
+	child := node.AddChild(cid)
+	child.AddCloser("gatewayConn", gatewayConn.Close)
+	child.AddProcess("gatewayConn", func() {
+		handleGatewayConnection(child, gatewayConn, ships)
+	})
+}
+
+func handleGatewayConnection(node tree.Node, gatewayConn net.Conn, ships Ships) {
+	tools.KeepAlive(gatewayConn, 5)
+	dao := node.GetValue("dao").(Dao)
+	hostname := node.GetValue("hostname").(string)
+	metrics := node.GetValue("metrics").(Metrics)
+	remote := gatewayConn.RemoteAddr().String()
+	err := gatewayConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ba := make([]byte, 1)
+	_, err = io.ReadFull(gatewayConn, ba)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	line, err := readLine(gatewayConn, ba[0])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	//[consumer:secret] ship-name host:port
+	parts := strings.Fields(line)
+	consumer, secret := "", ""
+	if len(parts) == 3 {
+		creds := strings.SplitN(parts[0], ":", 2)
+		if len(creds) != 2 {
+			log.Println(fmt.Errorf("gateway invalid consumer"))
+			return
+		}
+		consumer, secret = creds[0], creds[1]
+		parts = parts[1:]
+	}
+	if len(parts) != 2 {
+		log.Println(fmt.Errorf("gateway invalid line with %d fields", len(parts)))
+		return
+	}
+	name := parts[0]
+	addr := parts[1]
+	err = gatewayConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Println(name, err)
+		return
+	}
+	mode, err := lineConsumer(dao, name, consumer, secret)
+	if err != nil {
+		dao.AddAudit(node.Name(), "consumer-denied", name, "", consumer, hostname, remote)
+		fmt.Fprintf(gatewayConn, "err: %v\n", err)
+		log.Println(name, err)
+		return
+	}
+	ship := ships.Get(name)
+	key := ""
+	if ship != nil {
+		key = ship.GetValue("key").(string)
+	}
+	err = checkDestination(node, name, key, addr)
+	if err != nil {
+		fmt.Fprintf(gatewayConn, "err: %v\n", err)
+		log.Println(name, err)
+		return
+	}
+	if mode != consumerNone {
+		dao.AddAudit(node.Name(), "consumer", name, "", consumer, hostname, addr)
+	}
+	if ship == nil {
+		relayPeer(node, gatewayConn, name, addr, consumer)
+		return
+	}
+	sshConn := ship.GetValue("ssh").(*ssh.ServerConn)
+	sshChan, reqChan, err := openForward(sshConn, addr)
+	if err != nil {
+		metrics.ForwardFailed(name)
+		log.Println(name, err)
+		return
+	}
+	pipeForward(node, gatewayConn, remote, sshChan, reqChan, name, key, name)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/samuelventura/go-tree"
+)
+
+const hookAttempts = 10
+
+var hookEvents = map[string]bool{
+	"docked":      true,
+	"undocked":    true,
+	"replaced":    true,
+	"auth-failed": true,
+}
+
+type hooksDso struct {
+	mutex *sync.RWMutex
+	dao   Dao
+	names []string
+}
+
+type Hooks interface {
+	Enabled() []string
+	Reload()
+}
+
+func NewHooks(dao Dao) Hooks {
+	dso := &hooksDso{}
+	dso.mutex = &sync.RWMutex{}
+	dso.dao = dao
+	dso.Reload()
+	return dso
+}
+
+func (dso *hooksDso) Enabled() []string {
+	dso.mutex.RLock()
+	defer dso.mutex.RUnlock()
+	return dso.names
+}
+
+func (dso *hooksDso) Reload() {
+	names := []string{}
+	for _, dro := range dso.dao.EnabledHooks() {
+		names = append(names, dro.Name)
+	}
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.names = names
+}
+
+func hooks(node tree.Node) {
+	dao := node.GetValue("dao").(Dao)
+	events := node.GetValue("events").(Events)
+	cache := node.GetValue("hooks").(Hooks)
+	hostname := node.GetValue("hostname").(string)
+	//outbox rows are written by the publisher so none is dropped
+	events.Handle(func(event *Event) {
+		if !hookEvents[event.Type] {
+			return
+		}
+		//keeps the database off the handshake path when there are no hooks
+		names := cache.Enabled()
+		if len(names) == 0 {
+			return
+		}
+		select {
+		case <-node.Closed():
+			return
+		default:
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for _, name := range names {
+			dao.AddOutbox(name, hostname, event.Type, string(payload))
+		}
+	})
+	node.AddProcess("delivery", func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		for {
+			timer := time.NewTimer(time.Second)
+			select {
+			case <-timer.C:
+			case <-node.Closed():
+				timer.Stop()
+				return
+			}
+			for _, dro := range dao.DueOutbox(hostname, time.Now(), 20) {
+				deliverHook(dao, client, dro)
+			}
+		}
+	})
+}
+
+func deliverHook(dao Dao, client *http.Client, dro *OutboxDro) {
+	attempt := dro.Attempts + 1
+	status, err := postHook(dao, client, dro)
+	delivery := &DeliveryDro{}
+	delivery.Outbox = dro.ID
+	delivery.Hook = dro.Hook
+	delivery.Event = dro.Event
+	delivery.Wts = time.Now()
+	delivery.Attempt = attempt
+	delivery.Status = status
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	dao.AddDelivery(delivery)
+	if err == nil {
+		dao.UpdateOutbox(dro.ID, attempt, time.Time{}, true)
+		return
+	}
+	if attempt >= hookAttempts {
+		log.Println("hook", dro.Hook, "giving up", dro.ID, err)
+		dao.UpdateOutbox(dro.ID, attempt, time.Time{}, true)
+		return
+	}
+	//exponential backoff capped to an hour
+	backoff := time.Duration(1<<uint(attempt)) * time.Second
+	if backoff > time.Hour {
+		backoff = time.Hour
+	}
+	dao.UpdateOutbox(dro.ID, attempt, time.Now().Add(backoff), false)
+}
+
+func postHook(dao Dao, client *http.Client, dro *OutboxDro) (int, error) {
+	hook, err := dao.GetHook(dro.Hook)
+	if err != nil {
+		return 0, err
+	}
+	body := []byte(dro.Payload)
+	req, err := http.NewRequest(http.MethodPost, hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dock-Event", dro.Event)
+	req.Header.Set("X-Dock-Delivery", strconv.FormatUint(uint64(dro.ID), 10))
+	req.Header.Set("X-Dock-Signature", "sha256="+hookSignature(hook.Secret, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func hookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
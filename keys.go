@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/samuelventura/go-tree"
+	"golang.org/x/crypto/ssh"
+)
+
+type keysDso struct {
+	mutex   *sync.RWMutex
+	dao     Dao
+	keys    map[string]*KeyDro
+	grants  map[string]bool
+	cas     map[string]*CaDro
+	revoked map[string]bool
+}
+
+type Keys interface {
+	Find(key ssh.PublicKey) *KeyDro
+	IsGranted(key, ship string) bool
+	FindCa(key ssh.PublicKey) *CaDro
+	IsRevoked(ca string, serial uint64) bool
+	Reload()
+}
+
+func NewKeys(dao Dao) Keys {
+	dso := &keysDso{}
+	dso.mutex = &sync.RWMutex{}
+	dso.dao = dao
+	dso.Reload()
+	return dso
+}
+
+func (dso *keysDso) Find(key ssh.PublicKey) *KeyDro {
+	dso.mutex.RLock()
+	defer dso.mutex.RUnlock()
+	return dso.keys[ssh.FingerprintSHA256(key)]
+}
+
+func (dso *keysDso) IsGranted(key, ship string) bool {
+	dso.mutex.RLock()
+	defer dso.mutex.RUnlock()
+	return dso.grants[key+"\n"+ship]
+}
+
+func (dso *keysDso) FindCa(key ssh.PublicKey) *CaDro {
+	dso.mutex.RLock()
+	defer dso.mutex.RUnlock()
+	return dso.cas[ssh.FingerprintSHA256(key)]
+}
+
+func (dso *keysDso) IsRevoked(ca string, serial uint64) bool {
+	dso.mutex.RLock()
+	defer dso.mutex.RUnlock()
+	return dso.revoked[fmt.Sprintf("%s\n%d", ca, serial)]
+}
+
+func (dso *keysDso) Reload() {
+	//parsed outside the lock, swapped in one step
+	keys := make(map[string]*KeyDro)
+	for _, dro := range dso.dao.EnabledKeys() {
+		pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(dro.Key))
+		if err != nil {
+			log.Println("Ignoring invalid key", dro.Name)
+			continue
+		}
+		keys[ssh.FingerprintSHA256(pubkey)] = dro
+	}
+	grants := make(map[string]bool)
+	for _, dro := range dso.dao.AllGrants() {
+		grants[dro.Key+"\n"+dro.Ship] = true
+	}
+	cas := make(map[string]*CaDro)
+	for _, dro := range dso.dao.EnabledCas() {
+		pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(dro.Key))
+		if err != nil {
+			log.Println("Ignoring invalid ca", dro.Name)
+			continue
+		}
+		cas[ssh.FingerprintSHA256(pubkey)] = dro
+	}
+	revoked := make(map[string]bool)
+	for _, dro := range dso.dao.AllRevoked() {
+		revoked[fmt.Sprintf("%s\n%d", dro.Ca, dro.Serial)] = true
+	}
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.keys = keys
+	dso.grants = grants
+	dso.cas = cas
+	dso.revoked = revoked
+}
+
+func keycache(node tree.Node) {
+	//picks up changes made by other instances
+	keys := node.GetValue("keys").(Keys)
+	acls := node.GetValue("acls").(Acls)
+	policies := node.GetValue("policies").(Policies)
+	hooks := node.GetValue("hooks").(Hooks)
+	poll := time.Duration(node.GetValue("keypoll").(int64)) * time.Second
+	node.AddProcess("poll", func() {
+		for {
+			timer := time.NewTimer(poll)
+			select {
+			case <-timer.C:
+				keys.Reload()
+				acls.Reload()
+				policies.Reload()
+				hooks.Reload()
+			case <-node.Closed():
+				timer.Stop()
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/samuelventura/go-tree"
+)
+
+type limiterDso struct {
+	mutex       *sync.Mutex
+	dao         Dao
+	connections int
+	failures    int
+	window      time.Duration
+	ban         time.Duration
+	conns       map[string][]time.Time
+	fails       map[string][]time.Time
+	bans        map[string]time.Time
+}
+
+type Limiter interface {
+	Banned(ip string) bool
+	Connect(ip string) bool
+	Failed(ip string) bool
+	Unban(ip string)
+	Reload()
+}
+
+func NewLimiter(dao Dao, connections, failures int, window, ban time.Duration) Limiter {
+	dso := &limiterDso{}
+	dso.mutex = &sync.Mutex{}
+	dso.dao = dao
+	dso.connections = connections
+	dso.failures = failures
+	dso.window = window
+	dso.ban = ban
+	dso.conns = make(map[string][]time.Time)
+	dso.fails = make(map[string][]time.Time)
+	dso.Reload()
+	return dso
+}
+
+func (dso *limiterDso) Banned(ip string) bool {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	until, ok := dso.bans[ip]
+	return ok && time.Now().Before(until)
+}
+
+func (dso *limiterDso) Connect(ip string) bool {
+	//false when over the connection rate
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	return dso.hit(dso.conns, ip) <= dso.connections
+}
+
+func (dso *limiterDso) Failed(ip string) bool {
+	//true when the failure got the ip banned
+	dso.mutex.Lock()
+	count := dso.hit(dso.fails, ip)
+	if count < dso.failures {
+		dso.mutex.Unlock()
+		return false
+	}
+	until := time.Now().Add(dso.ban)
+	dso.bans[ip] = until
+	delete(dso.fails, ip)
+	dso.mutex.Unlock()
+	dso.dao.AddBan(ip, "auth", until)
+	return true
+}
+
+func (dso *limiterDso) Unban(ip string) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	delete(dso.bans, ip)
+	delete(dso.fails, ip)
+}
+
+func (dso *limiterDso) Reload() {
+	//picks up bans from other instances and drops idle windows
+	bans := make(map[string]time.Time)
+	for _, dro := range dso.dao.ListBans(time.Now()) {
+		bans[dro.IP] = dro.Until
+	}
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.bans = bans
+	now := time.Now()
+	for _, hits := range []map[string][]time.Time{dso.conns, dso.fails} {
+		for ip, times := range hits {
+			if len(times) == 0 || now.Sub(times[len(times)-1]) > dso.window {
+				delete(hits, ip)
+			}
+		}
+	}
+}
+
+func (dso *limiterDso) hit(hits map[string][]time.Time, ip string) int {
+	//sliding window, oldest hits are dropped first
+	now := time.Now()
+	times := hits[ip]
+	index := 0
+	for index < len(times) && now.Sub(times[index]) > dso.window {
+		index++
+	}
+	times = append(times[index:], now)
+	hits[ip] = times
+	return len(times)
+}
+
+func limits(node tree.Node) {
+	limiter := node.GetValue("limiter").(Limiter)
+	poll := time.Duration(node.GetValue("keypoll").(int64)) * time.Second
+	node.AddProcess("poll", func() {
+		for {
+			timer := time.NewTimer(poll)
+			select {
+			case <-timer.C:
+				limiter.Reload()
+			case <-node.Closed():
+				timer.Stop()
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samuelventura/go-tree"
+)
+
+type ShipStatus struct {
+	Name      string
+	Enabled   bool
+	Port      int
+	Connected bool
+	Id        string
+	Key       string
+	Remote    string
+	Since     *time.Time
+	Proxy     string
+	ProxyPort int
+	Proxies   int64
+}
+
+func shipStatus(dro *ShipDro, node tree.Node, metrics Metrics) *ShipStatus {
+	status := &ShipStatus{}
+	status.Name = dro.Name
+	status.Enabled = dro.Enabled
+	status.Port = dro.Port
+	if node != nil {
+		since := node.GetValue("since").(time.Time)
+		status.Connected = true
+		status.Id = node.Name()
+		status.Key = node.GetValue("key").(string)
+		status.Remote = node.GetValue("remote").(string)
+		status.Since = &since
+		status.Proxy = node.GetValue("proxy").(string)
+		status.ProxyPort = node.GetValue("proxyport").(int)
+		status.Proxies = metrics.ProxyCount(dro.Name)
+	}
+	return status
+}
+
+func listShips(c *gin.Context, list []*ShipStatus) (gin.H, error) {
+	//filters: name substring, key, enabled, connected
+	name := c.Query("name")
+	key := c.Query("key")
+	filtered := make([]*ShipStatus, 0, len(list))
+	for _, status := range list {
+		if len(name) > 0 && !strings.Contains(status.Name, name) {
+			continue
+		}
+		if len(key) > 0 && status.Key != key {
+			continue
+		}
+		if value := c.Query("enabled"); len(value) > 0 {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, err
+			}
+			if status.Enabled != enabled {
+				continue
+			}
+		}
+		if value := c.Query("connected"); len(value) > 0 {
+			connected, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, err
+			}
+			if status.Connected != connected {
+				continue
+			}
+		}
+		filtered = append(filtered, status)
+	}
+	var less func(a, b *ShipStatus) bool
+	switch c.DefaultQuery("sort", "name") {
+	case "name":
+		less = func(a, b *ShipStatus) bool { return a.Name < b.Name }
+	case "port":
+		less = func(a, b *ShipStatus) bool { return a.ProxyPort < b.ProxyPort }
+	case "proxies":
+		less = func(a, b *ShipStatus) bool { return a.Proxies < b.Proxies }
+	case "since":
+		less = func(a, b *ShipStatus) bool {
+			if a.Since == nil || b.Since == nil {
+				return b.Since == nil && a.Since != nil
+			}
+			return a.Since.Before(*b.Since)
+		}
+	default:
+		return nil, fmt.Errorf("invalid sort %s", c.Query("sort"))
+	}
+	desc := c.Query("order") == "desc"
+	sort.SliceStable(filtered, func(i, j int) bool {
+		if desc {
+			return less(filtered[j], filtered[i])
+		}
+		return less(filtered[i], filtered[j])
+	})
+	offset, err := strconv.ParseUint(c.DefaultQuery("offset", "0"), 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := strconv.ParseUint(c.DefaultQuery("limit", "100"), 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 1 || limit > 1000 {
+		return nil, fmt.Errorf("limit out of range 1-1000")
+	}
+	total := len(filtered)
+	start := int(offset)
+	if start > total {
+		start = total
+	}
+	end := start + int(limit)
+	if end > total {
+		end = total
+	}
+	return gin.H{"items": filtered[start:end], "total": total}, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type LogFilter struct {
+	Ship   string
+	Key    string
+	Host   string
+	Event  string
+	From   time.Time
+	To     time.Time
+	Cursor *LogCursor
+	Limit  int
+}
+
+type LogCursor struct { //keyset over wts, sid, event desc
+	Wts   time.Time
+	Sid   string
+	Event string
+}
+
+type LogSession struct {
+	Sid     string
+	Ship    string
+	Key     string
+	Host    string
+	IP      string
+	Port    int
+	Start   time.Time
+	Stop    *time.Time
+	Seconds float64
+}
+
+func parseLogFilter(c *gin.Context) (*LogFilter, error) {
+	filter := &LogFilter{}
+	filter.Ship = c.Query("ship")
+	filter.Key = c.Query("key")
+	filter.Host = c.Query("host")
+	filter.Event = c.Query("event")
+	filter.Limit = 100
+	var err error
+	//sqlite compares wts as text stored in the local offset
+	if value := c.Query("from"); len(value) > 0 {
+		filter.From, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, err
+		}
+		filter.From = filter.From.Local()
+	}
+	if value := c.Query("to"); len(value) > 0 {
+		filter.To, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, err
+		}
+		filter.To = filter.To.Local()
+	}
+	if value := c.Query("limit"); len(value) > 0 {
+		limit, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		if limit < 1 || limit > 1000 {
+			return nil, fmt.Errorf("limit out of range 1-1000")
+		}
+		filter.Limit = int(limit)
+	}
+	if value := c.Query("cursor"); len(value) > 0 {
+		filter.Cursor, err = decodeLogCursor(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+func encodeLogCursor(dro *LogDro) string {
+	text := strings.Join([]string{dro.Wts.Format(time.RFC3339Nano), dro.Sid, dro.Event}, "\n")
+	return base64.RawURLEncoding.EncodeToString([]byte(text))
+}
+
+func decodeLogCursor(value string) (*LogCursor, error) {
+	ba, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(string(ba), "\n")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	wts, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	return &LogCursor{Wts: wts.Local(), Sid: parts[1], Event: parts[2]}, nil
+}
+
+func nextLogCursor(dros []*LogDro, limit int) string {
+	//empty when there are no more rows
+	if len(dros) < limit {
+		return ""
+	}
+	return encodeLogCursor(dros[len(dros)-1])
+}
+
+func logsCsv(dros []*LogDro) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	writer := csv.NewWriter(buf)
+	err := writer.Write([]string{"wts", "event", "sid", "ship", "key", "host", "ip", "port", "addr", "consumer"})
+	if err != nil {
+		return nil, err
+	}
+	for _, dro := range dros {
+		err = writer.Write([]string{
+			dro.Wts.Format(time.RFC3339Nano),
+			dro.Event,
+			dro.Sid,
+			dro.Ship,
+			dro.Key,
+			dro.Host,
+			dro.IP,
+			strconv.Itoa(dro.Port),
+			dro.Addr,
+			dro.Consumer,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+func logSessions(adds []*LogDro, dels []*LogDro) []*LogSession {
+	stops := make(map[string]time.Time)
+	for _, dro := range dels {
+		stops[dro.Sid] = dro.Wts
+	}
+	sessions := make([]*LogSession, 0, len(adds))
+	for _, dro := range adds {
+		session := &LogSession{}
+		session.Sid = dro.Sid
+		session.Ship = dro.Ship
+		session.Key = dro.Key
+		session.Host = dro.Host
+		session.IP = dro.IP
+		session.Port = dro.Port
+		session.Start = dro.Wts
+		stop, ok := stops[dro.Sid]
+		if ok {
+			session.Stop = &stop
+			session.Seconds = stop.Sub(dro.Wts).Seconds()
+		} else {
+			//still docked or dock exited uncleanly
+			session.Seconds = time.Since(dro.Wts).Seconds()
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/samuelventura/go-state"
 	"github.com/samuelventura/go-tools"
@@ -27,38 +28,105 @@ func main() {
 	rnode.SetValue("source", tools.GetEnviron("DOCK_DB_SOURCE", tools.WithExtension("db3")))
 	rnode.SetValue("driver", tools.GetEnviron("DOCK_DB_DRIVER", "sqlite"))
 	rnode.SetValue("state", tools.GetEnviron("DOCK_STATE", tools.WithExtension("state")))
+	rnode.SetValue("portrange", tools.GetEnviron("DOCK_PORT_RANGE", ""))
+	rnode.SetValue("peer", tools.GetEnviron("DOCK_ENDPOINT_PEER", ""))
+	//keep secret out of log
+	rnode.SetValue("peersecret", os.Getenv("DOCK_PEER_SECRET"))
 	dao := NewDao(rnode) //close on root
 	rnode.AddCloser("dao", dao.Close)
 	rnode.SetValue("dao", dao)
 	for _, key := range dao.EnabledKeys() {
 		log.Println("key", key.Name, strings.TrimSpace(key.Key))
 	}
-	dao.ClearShips()
+	rnode.SetValue("keys", NewKeys(dao))
+	rnode.SetValue("acls", NewAcls(dao))
+	rnode.SetValue("hooks", NewHooks(dao))
+	rnode.SetValue("policies", NewPolicies(dao, tools.GetEnvironBool("DOCK_POLICY_DENY", false)))
+	rnode.SetValue("keypoll", tools.GetEnvironInt("DOCK_KEY_POLL_SECONDS", 10, 32, 10))
+	rnode.SetValue("limiter", NewLimiter(dao,
+		int(tools.GetEnvironInt("DOCK_RATE_CONNECTIONS", 10, 32, 60)),
+		int(tools.GetEnvironInt("DOCK_RATE_FAILURES", 10, 32, 10)),
+		time.Duration(tools.GetEnvironInt("DOCK_RATE_SECONDS", 10, 32, 60))*time.Second,
+		time.Duration(tools.GetEnvironInt("DOCK_BAN_SECONDS", 10, 32, 600))*time.Second))
 	rnode.SetValue("ships", NewShips())
+	rnode.SetValue("metrics", NewMetrics())
+	rnode.SetValue("events", NewEvents())
+	rnode.SetValue("lease", tools.GetEnvironInt("DOCK_LEASE_SECONDS", 10, 32, 30))
 
 	snode := state.Serve(rnode, rnode.GetValue("state").(string))
 	defer snode.WaitDisposed()
 	defer snode.Close()
 
+	cnode := rnode.AddChild("cluster")
+	defer cnode.WaitDisposed()
+	defer cnode.Close()
+	cluster(cnode)
+
+	knode := rnode.AddChild("keys")
+	defer knode.WaitDisposed()
+	defer knode.Close()
+	keycache(knode)
+
+	lnode := rnode.AddChild("limits")
+	defer lnode.WaitDisposed()
+	defer lnode.Close()
+	limits(lnode)
+
+	hnode := rnode.AddChild("hooks")
+	defer hnode.WaitDisposed()
+	defer hnode.Close()
+	hooks(hnode)
+
 	enode := rnode.AddChild("ssh")
 	defer enode.WaitDisposed()
 	defer enode.Close()
 	enode.SetValue("endpoint", tools.GetEnviron("DOCK_ENDPOINT_SSH", "0.0.0.0:31622"))
 	enode.SetValue("hostkey", tools.GetEnviron("DOCK_HOSTKEY", tools.WithExtension("key")))
 	enode.SetValue("maxships", tools.GetEnvironInt("DOCK_MAXSHIPS", 10, 32, 1000))
+	enode.SetValue("maxforwards", tools.GetEnvironInt("DOCK_MAXFORWARDS", 10, 32, 16))
+	enode.SetValue("consumercerts", NewConsumerCerts(
+		tools.GetEnviron("DOCK_CONSUMER_CERT", ""),
+		tools.GetEnviron("DOCK_CONSUMER_KEY", ""),
+		tools.GetEnviron("DOCK_CONSUMER_CA", "")))
+	enode.SetValue("handshake", tools.GetEnvironInt("DOCK_HANDSHAKE_SECONDS", 10, 32, 10))
 	enode.SetValue("export", tools.GetEnviron("DOCK_EXPORT_IP", "127.0.0.1"))
+	enode.SetValue("exportunix", tools.GetEnviron("DOCK_EXPORT_UNIX", ""))
+	enode.SetValue("exportmode", parseExportMode(tools.GetEnviron("DOCK_EXPORT_MODE", "0660")))
+	enode.SetValue("exportowner", parseExportOwner(tools.GetEnviron("DOCK_EXPORT_OWNER", "")))
 	sshd(enode)
 
+	pnode := rnode.AddChild("peer")
+	defer pnode.WaitDisposed()
+	defer pnode.Close()
+	peer(pnode)
+
+	gnode := rnode.AddChild("gateway")
+	defer gnode.WaitDisposed()
+	defer gnode.Close()
+	gnode.SetValue("endpoint", tools.GetEnviron("DOCK_ENDPOINT_GATEWAY", ""))
+	gateway(gnode)
+
 	anode := rnode.AddChild("api")
 	defer anode.WaitDisposed()
 	defer anode.Close()
 	anode.SetValue("endpoint", tools.GetEnviron("DOCK_ENDPOINT_API", "127.0.0.1:31623"))
+	anode.SetValue("cert", tools.GetEnviron("DOCK_API_CERT", ""))
+	anode.SetValue("certkey", tools.GetEnviron("DOCK_API_KEY", ""))
+	anode.SetValue("clientca", tools.GetEnviron("DOCK_API_CLIENTCA", ""))
+	anode.SetValue("auth", tools.GetEnvironBool("DOCK_API_AUTH", false))
+	anode.SetValue("token", os.Getenv("DOCK_API_TOKEN")) //keep secret out of log
 	api(anode)
 
 	select {
 	case <-rnode.Closed():
 	case <-snode.Closed():
 	case <-enode.Closed():
+	case <-cnode.Closed():
+	case <-knode.Closed():
+	case <-lnode.Closed():
+	case <-hnode.Closed():
+	case <-pnode.Closed():
+	case <-gnode.Closed():
 	case <-anode.Closed():
 	case <-ctrlc:
 	case <-stdin:
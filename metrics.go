@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var rttBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricsDso struct {
+	mutex      *sync.Mutex
+	handshakes map[string]int64
+	rttCounts  []int64
+	rttSum     float64
+	rttCount   int64
+	proxies    map[string]int64
+	bytes      map[string]int64
+	failures   map[string]int64
+}
+
+type Metrics interface {
+	Handshake(reason string)
+	PingRtt(seconds float64)
+	ProxyOpened(ship string)
+	ProxyClosed(ship string)
+	ProxyBytes(ship, direction string, count int64)
+	ForwardFailed(ship string)
+	ProxyCount(ship string) int64
+	Write(w io.Writer, docked int)
+}
+
+func NewMetrics() Metrics {
+	dso := &metricsDso{}
+	dso.mutex = &sync.Mutex{}
+	dso.handshakes = make(map[string]int64)
+	dso.rttCounts = make([]int64, len(rttBuckets))
+	dso.proxies = make(map[string]int64)
+	dso.bytes = make(map[string]int64)
+	dso.failures = make(map[string]int64)
+	return dso
+}
+
+func (dso *metricsDso) Handshake(reason string) {
+	//reason is success for completed handshakes
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.handshakes[reason]++
+}
+
+func (dso *metricsDso) PingRtt(seconds float64) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	for i, le := range rttBuckets {
+		if seconds <= le {
+			dso.rttCounts[i]++
+		}
+	}
+	dso.rttSum += seconds
+	dso.rttCount++
+}
+
+func (dso *metricsDso) ProxyOpened(ship string) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.proxies[ship]++
+}
+
+func (dso *metricsDso) ProxyClosed(ship string) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.proxies[ship]--
+	if dso.proxies[ship] <= 0 {
+		delete(dso.proxies, ship)
+	}
+}
+
+func (dso *metricsDso) ProxyBytes(ship, direction string, count int64) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.bytes[labels("ship", ship, "direction", direction)] += count
+}
+
+func (dso *metricsDso) ForwardFailed(ship string) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.failures[ship]++
+}
+
+func (dso *metricsDso) ProxyCount(ship string) int64 {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	return dso.proxies[ship]
+}
+
+func (dso *metricsDso) Write(w io.Writer, docked int) {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	fmt.Fprintln(w, "# HELP dock_ships_docked Ships currently docked.")
+	fmt.Fprintln(w, "# TYPE dock_ships_docked gauge")
+	fmt.Fprintf(w, "dock_ships_docked %d\n", docked)
+	fmt.Fprintln(w, "# HELP dock_ssh_handshakes_total SSH handshakes by result reason.")
+	fmt.Fprintln(w, "# TYPE dock_ssh_handshakes_total counter")
+	for _, reason := range sortedKeys(dso.handshakes) {
+		fmt.Fprintf(w, "dock_ssh_handshakes_total%s %d\n",
+			labels("reason", reason), dso.handshakes[reason])
+	}
+	fmt.Fprintln(w, "# HELP dock_ping_rtt_seconds Ship ping round trip time.")
+	fmt.Fprintln(w, "# TYPE dock_ping_rtt_seconds histogram")
+	for i, le := range rttBuckets {
+		fmt.Fprintf(w, "dock_ping_rtt_seconds_bucket%s %d\n",
+			labels("le", fmt.Sprint(le)), dso.rttCounts[i])
+	}
+	fmt.Fprintf(w, "dock_ping_rtt_seconds_bucket%s %d\n", labels("le", "+Inf"), dso.rttCount)
+	fmt.Fprintf(w, "dock_ping_rtt_seconds_sum %g\n", dso.rttSum)
+	fmt.Fprintf(w, "dock_ping_rtt_seconds_count %d\n", dso.rttCount)
+	fmt.Fprintln(w, "# HELP dock_proxy_connections Active proxy connections per ship.")
+	fmt.Fprintln(w, "# TYPE dock_proxy_connections gauge")
+	for _, ship := range sortedKeys(dso.proxies) {
+		fmt.Fprintf(w, "dock_proxy_connections%s %d\n",
+			labels("ship", ship), dso.proxies[ship])
+	}
+	fmt.Fprintln(w, "# HELP dock_proxy_bytes_total Bytes copied per ship, in is toward the ship.")
+	fmt.Fprintln(w, "# TYPE dock_proxy_bytes_total counter")
+	for _, key := range sortedKeys(dso.bytes) {
+		fmt.Fprintf(w, "dock_proxy_bytes_total%s %d\n", key, dso.bytes[key])
+	}
+	fmt.Fprintln(w, "# HELP dock_forward_failures_total Failed forward channel opens per ship.")
+	fmt.Fprintln(w, "# TYPE dock_forward_failures_total counter")
+	for _, ship := range sortedKeys(dso.failures) {
+		fmt.Fprintf(w, "dock_forward_failures_total%s %d\n",
+			labels("ship", ship), dso.failures[ship])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type countWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	//totals are added by the owner on flush to keep locks off the copy
+	n, err := cw.writer.Write(p)
+	atomic.AddInt64(&cw.count, int64(n))
+	return n, err
+}
+
+func (cw *countWriter) Count() int64 {
+	return atomic.LoadInt64(&cw.count)
+}
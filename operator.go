@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/samuelventura/go-tree"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	roleShip  = ""
+	roleAdmin = "admin"
+)
+
+func validRole(role string) bool {
+	return role == roleShip || role == roleAdmin
+}
+
+type directTcpip struct { //RFC 4254 7.2
+	HostToConnect  string
+	PortToConnect  uint32
+	OriginatorAddr string
+	OriginatorPort uint32
+}
+
+func handleOperator(node tree.Node, sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	//operators never dock, the user names the target ship
+	hostname := node.GetValue("hostname").(string)
+	events := node.GetValue("events").(Events)
+	ship := sshConn.User()
+	key := sshConn.Permissions.Extensions["key-id"]
+	remote := sshConn.RemoteAddr().String()
+	node.AddCloser("sshConn", sshConn.Close)
+	node.SetValue("ssh", sshConn)
+	node.SetValue("ship", ship)
+	node.SetValue("key", key)
+	log.Println(ship, "operator", key, remote)
+	events.Publish(&Event{Type: "operator", Ship: ship, Sid: node.Name(), Key: key,
+		Host: hostname, Detail: remote})
+	node.AddProcess("ssh reqs reply", func() {
+		for req := range reqs {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	})
+	id := NewId("direct-" + remote)
+	for nch := range chans {
+		if nch.ChannelType() != "direct-tcpip" {
+			nch.Reject(ssh.Prohibited, "unsupported")
+			continue
+		}
+		msg := &directTcpip{}
+		err := ssh.Unmarshal(nch.ExtraData(), msg)
+		if err != nil {
+			nch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		addr := net.JoinHostPort(msg.HostToConnect, strconv.Itoa(int(msg.PortToConnect)))
+		setupOperatorChannel(node, nch, id, addr)
+	}
+}
+
+func setupOperatorChannel(node tree.Node, nch ssh.NewChannel, id Id, addr string) {
+	defer node.IfRecoverAction(func() {
+		nch.Reject(ssh.ConnectionFailed, "internal error")
+	})
+	cid := id.Next(addr)
+	child := node.AddChild(cid)
+	child.AddProcess("direct-tcpip", func() {
+		handleOperatorChannel(child, nch, addr)
+	})
+}
+
+func handleOperatorChannel(node tree.Node, nch ssh.NewChannel, addr string) {
+	dao := node.GetValue("dao").(Dao)
+	ships := node.GetValue("ships").(Ships)
+	metrics := node.GetValue("metrics").(Metrics)
+	hostname := node.GetValue("hostname").(string)
+	ship := node.GetValue("ship").(string)
+	key := node.GetValue("key").(string)
+	sid := node.Name()
+	target := ships.Get(ship)
+	if target == nil {
+		dao.AddAudit(sid, "direct-denied", ship, key, "", hostname, addr)
+		nch.Reject(ssh.ConnectionFailed, "ship not connected")
+		return
+	}
+	//admin keys are still bound by the ship destination policies
+	err := checkDestination(node, ship, key, addr)
+	if err != nil {
+		nch.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+	sshConn := target.GetValue("ssh").(*ssh.ServerConn)
+	sshChan, reqChan, err := openForward(sshConn, addr)
+	if err != nil {
+		metrics.ForwardFailed(ship)
+		dao.AddAudit(sid, "direct-failed", ship, key, "", hostname, addr)
+		nch.Reject(ssh.ConnectionFailed, fmt.Sprint(err))
+		return
+	}
+	opChan, opReqs, err := nch.Accept()
+	if err != nil {
+		go ssh.DiscardRequests(reqChan)
+		sshChan.Close()
+		log.Println(addr, err)
+		return
+	}
+	node.AddCloser("opChan", opChan.Close)
+	node.AddProcess("DiscardRequests(opReqs)", func() {
+		ssh.DiscardRequests(opReqs)
+	})
+	dao.AddAudit(sid, "direct-opened", ship, key, "", hostname, addr)
+	defer dao.AddAudit(sid, "direct-closed", ship, key, "", hostname, addr)
+	pipeForward(node, opChan, addr, sshChan, reqChan, ship, key, addr)
+}
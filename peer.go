@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samuelventura/go-tools"
+	"github.com/samuelventura/go-tree"
+	"golang.org/x/crypto/ssh"
+)
+
+const peerWindow = 30 * time.Second
+
+type noncesDso struct {
+	mutex  *sync.Mutex
+	window time.Duration
+	nonces map[string]time.Time
+}
+
+type Nonces interface {
+	Use(nonce string) bool
+}
+
+func NewNonces(window time.Duration) Nonces {
+	dso := &noncesDso{}
+	dso.mutex = &sync.Mutex{}
+	dso.window = window
+	dso.nonces = make(map[string]time.Time)
+	return dso
+}
+
+func (dso *noncesDso) Use(nonce string) bool {
+	//false if already used within the window
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	now := time.Now()
+	for n, t := range dso.nonces {
+		if now.Sub(t) > 2*dso.window {
+			delete(dso.nonces, n)
+		}
+	}
+	_, ok := dso.nonces[nonce]
+	if ok {
+		return false
+	}
+	dso.nonces[nonce] = now
+	return true
+}
+
+func peer(node tree.Node) {
+	ships := node.GetValue("ships").(Ships)
+	endpoint := node.GetValue("peer").(string)
+	secret := node.GetValue("peersecret").(string)
+	if len(endpoint) == 0 {
+		log.Println("peer disabled")
+		return
+	}
+	if len(secret) == 0 {
+		log.Panicln("peer secret required")
+	}
+	listen, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		log.Panicln(err)
+	}
+	node.AddCloser("listen", listen.Close)
+	port := listen.Addr().(*net.TCPAddr).Port
+	log.Println("port peer", port)
+	nonces := NewNonces(peerWindow)
+	node.AddProcess("listen", func() {
+		id := NewId("peer-" + listen.Addr().String())
+		for {
+			peerConn, err := listen.Accept()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			setupPeerConnection(node, peerConn, ships, nonces, id)
+		}
+	})
+}
+
+func setupPeerConnection(node tree.Node, peerConn net.Conn, ships Ships, nonces Nonces, id Id) {
+	defer node.IfRecoverCloser(peerConn.Close)
+	addr := peerConn.RemoteAddr().String()
+	cid := id.Next(addr)
+	child := node.AddChild(cid)
+	child.AddCloser("peerConn", peerConn.Close)
+	child.AddProcess("peerConn", func() {
+		handlePeerConnection(child, peerConn, ships, nonces)
+	})
+}
+
+func handlePeerConnection(node tree.Node, peerConn net.Conn, ships Ships, nonces Nonces) {
+	tools.KeepAlive(peerConn, 5)
+	dao := node.GetValue("dao").(Dao)
+	secret := node.GetValue("peersecret").(string)
+	hostname := node.GetValue("hostname").(string)
+	metrics := node.GetValue("metrics").(Metrics)
+	err := peerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ba := make([]byte, 1)
+	_, err = io.ReadFull(peerConn, ba)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	line, err := readLine(peerConn, ba[0])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	name, addr, consumer, err := verifyPeerLine(secret, line, nonces)
+	if err != nil {
+		log.Println(peerConn.RemoteAddr(), err)
+		return
+	}
+	err = peerConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Println(name, err)
+		return
+	}
+	_, err = peerConsumer(dao, name, consumer)
+	if err != nil {
+		dao.AddAudit(node.Name(), "consumer-denied", name, "", consumer, hostname, peerConn.RemoteAddr().String())
+		fmt.Fprintf(peerConn, "err: %v\n", err)
+		log.Println(name, err)
+		return
+	}
+	ship := ships.Get(name)
+	if ship == nil {
+		log.Println(name, "ship not connected")
+		return
+	}
+	key := ship.GetValue("key").(string)
+	err = checkDestination(node, name, key, addr)
+	if err != nil {
+		fmt.Fprintf(peerConn, "err: %v\n", err)
+		log.Println(name, err)
+		return
+	}
+	sshConn := ship.GetValue("ssh").(*ssh.ServerConn)
+	sshChan, reqChan, err := openForward(sshConn, addr)
+	if err != nil {
+		metrics.ForwardFailed(name)
+		log.Println(name, err)
+		return
+	}
+	pipeForward(node, peerConn, peerConn.RemoteAddr().String(), sshChan, reqChan, name, key, name)
+}
+
+func relayPeer(node tree.Node, conn net.Conn, name, addr, consumer string) {
+	//relays a gateway connection to the dock instance owning the ship
+	dao := node.GetValue("dao").(Dao)
+	hostname := node.GetValue("hostname").(string)
+	endpoint := node.GetValue("peer").(string)
+	secret := node.GetValue("peersecret").(string)
+	if len(endpoint) == 0 {
+		log.Println(name, "ship not connected")
+		return
+	}
+	state, err := dao.ShipState(name)
+	if err != nil || state.Host == hostname {
+		log.Println(name, "ship not connected")
+		return
+	}
+	_, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		log.Println(name, err)
+		return
+	}
+	//export ip is only useful when routable
+	host := state.IP
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		host = state.Host
+	}
+	peerConn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 5*time.Second)
+	if err != nil {
+		log.Println(name, err)
+		return
+	}
+	node.AddCloser("peerConn", peerConn.Close)
+	line, err := signPeerLine(secret, name, addr, consumer, time.Now())
+	if err != nil {
+		log.Println(name, err)
+		return
+	}
+	_, err = peerConn.Write([]byte(line + "\n"))
+	if err != nil {
+		log.Println(name, err)
+		return
+	}
+	log.Println(name, "relay", state.Host)
+	node.AddProcess("Copy(peerConn, conn)", func() {
+		_, err := io.Copy(peerConn, conn)
+		if err != nil {
+			log.Println(name, err)
+		}
+	})
+	node.AddProcess("Copy(conn, peerConn)", func() {
+		_, err := io.Copy(conn, peerConn)
+		if err != nil {
+			log.Println(name, err)
+		}
+	})
+	node.WaitClosed()
+}
+
+func signPeerLine(secret, ship, addr, consumer string, now time.Time) (string, error) {
+	//ship host:port consumer unix-seconds nonce hex-hmac
+	ba := make([]byte, 16)
+	_, err := rand.Read(ba)
+	if err != nil {
+		return "", err
+	}
+	if len(consumer) == 0 {
+		consumer = "-"
+	}
+	payload := fmt.Sprintf("%s %s %s %d %s", ship, addr, consumer, now.Unix(), hex.EncodeToString(ba))
+	return payload + " " + peerMac(secret, payload), nil
+}
+
+func verifyPeerLine(secret, line string, nonces Nonces) (string, string, string, error) {
+	parts := strings.Fields(line)
+	if len(parts) != 6 {
+		return "", "", "", fmt.Errorf("peer invalid line")
+	}
+	payload := strings.Join(parts[:5], " ")
+	if !hmac.Equal([]byte(parts[5]), []byte(peerMac(secret, payload))) {
+		return "", "", "", fmt.Errorf("peer invalid signature")
+	}
+	secs, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return "", "", "", err
+	}
+	skew := time.Since(time.Unix(secs, 0))
+	if skew > peerWindow || skew < -peerWindow {
+		return "", "", "", fmt.Errorf("peer date out of range")
+	}
+	if !nonces.Use(parts[4]) {
+		return "", "", "", fmt.Errorf("peer nonce reused")
+	}
+	consumer := parts[2]
+	if consumer == "-" {
+		consumer = ""
+	}
+	return parts[0], parts[1], consumer, nil
+}
+
+func peerMac(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyPeerLine(t *testing.T) {
+	now := time.Now()
+	signed := func(secret, consumer string, when time.Time) string {
+		line, err := signPeerLine(secret, "sample", "10.0.0.1:22", consumer, when)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	tampered := strings.Replace(signed("s3", "", now), "10.0.0.1:22", "10.0.0.2:22", 1)
+	cases := []struct {
+		name     string
+		line     string
+		consumer string
+		fails    string
+	}{
+		{"valid", signed("s3", "", now), "", ""},
+		{"valid consumer", signed("s3", "bob", now), "bob", ""},
+		{"within window", signed("s3", "", now.Add(-peerWindow+2*time.Second)), "", ""},
+		{"bad signature", signed("other", "", now), "", "peer invalid signature"},
+		{"tampered address", tampered, "", "peer invalid signature"},
+		{"old date", signed("s3", "", now.Add(-peerWindow-2*time.Second)), "", "peer date out of range"},
+		{"future date", signed("s3", "", now.Add(peerWindow+2*time.Second)), "", "peer date out of range"},
+		{"missing fields", "sample 10.0.0.1:22", "", "peer invalid line"},
+		{"extra fields", signed("s3", "", now) + " extra", "", "peer invalid line"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ship, addr, consumer, err := verifyPeerLine("s3", c.line, NewNonces(peerWindow))
+			if len(c.fails) > 0 {
+				if err == nil || err.Error() != c.fails {
+					t.Fatalf("err %v expected %s", err, c.fails)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ship != "sample" || addr != "10.0.0.1:22" || consumer != c.consumer {
+				t.Fatalf("got %s %s %q", ship, addr, consumer)
+			}
+		})
+	}
+}
+
+func TestVerifyPeerLineNonce(t *testing.T) {
+	nonces := NewNonces(peerWindow)
+	line, err := signPeerLine("s3", "sample", "10.0.0.1:22", "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = verifyPeerLine("s3", line, nonces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = verifyPeerLine("s3", line, nonces)
+	if err == nil || err.Error() != "peer nonce reused" {
+		t.Fatalf("err %v expected nonce reused", err)
+	}
+	//a fresh line carries a fresh nonce
+	line, err = signPeerLine("s3", "sample", "10.0.0.1:22", "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = verifyPeerLine("s3", line, nonces)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoncesExpire(t *testing.T) {
+	nonces := NewNonces(time.Millisecond)
+	if !nonces.Use("a") || nonces.Use("a") {
+		t.Fatal("nonce reuse within window")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if !nonces.Use("a") {
+		t.Fatal("nonce kept past window")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/samuelventura/go-tree"
+)
+
+var errPolicyDenied = errors.New("destination not allowed")
+var errInvalidDestination = errors.New("invalid destination")
+
+type policyRule struct {
+	pattern string
+	ipnet   *net.IPNet
+	ports   [][2]int
+}
+
+type policiesDso struct {
+	mutex *sync.RWMutex
+	dao   Dao
+	deny  bool
+	ships map[string][]*policyRule
+}
+
+type Policies interface {
+	Check(ship, addr string) error
+	Reload()
+}
+
+func NewPolicies(dao Dao, deny bool) Policies {
+	//deny makes ships without rules unreachable
+	dso := &policiesDso{}
+	dso.mutex = &sync.RWMutex{}
+	dso.dao = dao
+	dso.deny = deny
+	dso.Reload()
+	return dso
+}
+
+func (dso *policiesDso) Check(ship, addr string) error {
+	host, port, err := parseDestination(addr)
+	if err != nil {
+		return err
+	}
+	dso.mutex.RLock()
+	defer dso.mutex.RUnlock()
+	rules, ok := dso.ships[ship]
+	if !ok {
+		if dso.deny {
+			return errPolicyDenied
+		}
+		return nil
+	}
+	//hostnames never match cidr rules, the ship resolves them
+	ip := net.ParseIP(host)
+	for _, rule := range rules {
+		if !rule.allowsPort(port) {
+			continue
+		}
+		if rule.ipnet != nil {
+			if ip != nil && rule.ipnet.Contains(ip) {
+				return nil
+			}
+			continue
+		}
+		matched, _ := path.Match(rule.pattern, strings.ToLower(host))
+		if matched {
+			return nil
+		}
+	}
+	return errPolicyDenied
+}
+
+func (dso *policiesDso) Reload() {
+	ships := make(map[string][]*policyRule)
+	for _, dro := range dso.dao.ListPolicies("") {
+		rule, err := parsePolicy(dro.Host, dro.Ports)
+		if err != nil {
+			log.Println("Ignoring invalid policy", dro.ID, err)
+			continue
+		}
+		ships[dro.Ship] = append(ships[dro.Ship], rule)
+	}
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	dso.ships = ships
+}
+
+func (rule *policyRule) allowsPort(port int) bool {
+	if len(rule.ports) == 0 {
+		return true
+	}
+	for _, r := range rule.ports {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePolicy(host, ports string) (*policyRule, error) {
+	//host is a glob pattern, an ip or a cidr, ports like 80,443,8000-8100
+	rule := &policyRule{}
+	if len(host) == 0 {
+		return nil, fmt.Errorf("host required")
+	}
+	if strings.Contains(host, "/") || net.ParseIP(host) != nil {
+		ipnet, err := parseCidr(host)
+		if err != nil {
+			return nil, err
+		}
+		rule.ipnet = ipnet
+	} else {
+		_, err := path.Match(host, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid host pattern %s", host)
+		}
+		rule.pattern = strings.ToLower(host)
+	}
+	if len(ports) == 0 || ports == "*" {
+		return rule, nil
+	}
+	for _, part := range strings.Split(ports, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		min, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ports %s", ports)
+		}
+		max := min
+		if len(bounds) == 2 {
+			max, err = strconv.ParseUint(bounds[1], 10, 16)
+			if err != nil || max < min {
+				return nil, fmt.Errorf("invalid ports %s", ports)
+			}
+		}
+		rule.ports = append(rule.ports, [2]int{int(min), int(max)})
+	}
+	return rule, nil
+}
+
+func parseDestination(addr string) (string, int, error) {
+	//host:port only, anything else is not a dial target
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w %q", errInvalidDestination, addr)
+	}
+	pv, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || pv == 0 {
+		return "", 0, fmt.Errorf("%w port %q", errInvalidDestination, addr)
+	}
+	if len(host) == 0 || len(host) > 253 {
+		return "", 0, fmt.Errorf("%w host %q", errInvalidDestination, addr)
+	}
+	if net.ParseIP(host) != nil {
+		return host, int(pv), nil
+	}
+	for _, r := range host {
+		valid := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') || r == '-' || r == '.' || r == '_'
+		if !valid {
+			return "", 0, fmt.Errorf("%w host %q", errInvalidDestination, addr)
+		}
+	}
+	return host, int(pv), nil
+}
+
+func checkDestination(node tree.Node, ship, key, addr string) error {
+	//denials are audited with the requested address
+	dao := node.GetValue("dao").(Dao)
+	policies := node.GetValue("policies").(Policies)
+	hostname := node.GetValue("hostname").(string)
+	err := policies.Check(ship, addr)
+	if err != nil {
+		dao.AddAudit(node.Name(), "forward-denied", ship, key, "", hostname, addr)
+	}
+	return err
+}
+
+func rejectedDestination(err error) bool {
+	return errors.Is(err, errPolicyDenied) || errors.Is(err, errInvalidDestination) ||
+		errors.Is(err, errConsumerDenied)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+type policiesDao struct {
+	Dao
+	policies []*PolicyDro
+}
+
+func (dao *policiesDao) ListPolicies(ship string) []*PolicyDro {
+	return dao.policies
+}
+
+func TestParseDestination(t *testing.T) {
+	cases := []struct {
+		addr string
+		host string
+		port int
+	}{
+		{"example.com:80", "example.com", 80},
+		{"Host-1.lan:65535", "Host-1.lan", 65535},
+		{"under_score:22", "under_score", 22},
+		{"10.0.0.1:443", "10.0.0.1", 443},
+		{"[::1]:22", "::1", 22},
+		{"[::ffff:10.0.0.1]:22", "::ffff:10.0.0.1", 22},
+		{"example.com", "", 0},
+		{"example.com:0", "", 0},
+		{"example.com:65536", "", 0},
+		{"example.com:http", "", 0},
+		{":80", "", 0},
+		{"bad host:80", "", 0},
+		{"a/b:80", "", 0},
+		{"[fe80::1%eth0]:22", "", 0},
+	}
+	for _, c := range cases {
+		t.Run(c.addr, func(t *testing.T) {
+			host, port, err := parseDestination(c.addr)
+			if len(c.host) == 0 {
+				if !errors.Is(err, errInvalidDestination) {
+					t.Fatalf("err %v expected invalid destination", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != c.host || port != c.port {
+				t.Fatalf("got %s %d expected %s %d", host, port, c.host, c.port)
+			}
+		})
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	cases := []struct {
+		name   string
+		host   string
+		ports  string
+		cidr   string
+		ranges [][2]int
+		fails  bool
+	}{
+		{"glob all ports", "*.LAN", "", "", nil, false},
+		{"star ports", "*", "*", "", nil, false},
+		{"single ip", "10.0.0.1", "22", "10.0.0.1/32", [][2]int{{22, 22}}, false},
+		{"cidr", "192.168.0.0/16", "80, 443", "192.168.0.0/16", [][2]int{{80, 80}, {443, 443}}, false},
+		{"ipv6 cidr", "fd00::/8", "8000-8100", "fd00::/8", [][2]int{{8000, 8100}}, false},
+		{"full range", "*", "0-65535", "", [][2]int{{0, 65535}}, false},
+		{"empty host", "", "", "", nil, true},
+		{"bad pattern", "[a", "", "", nil, true},
+		{"bad cidr", "10.0.0.0/33", "", "", nil, true},
+		{"bad ip", "10.0.0.256/8", "", "", nil, true},
+		{"reversed range", "*", "8100-8000", "", nil, true},
+		{"open range", "*", "80-", "", nil, true},
+		{"port overflow", "*", "65536", "", nil, true},
+		{"port name", "*", "http", "", nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rule, err := parsePolicy(c.host, c.ports)
+			if (err != nil) != c.fails {
+				t.Fatalf("err %v fails %v", err, c.fails)
+			}
+			if err != nil {
+				return
+			}
+			if len(c.cidr) > 0 && (rule.ipnet == nil || rule.ipnet.String() != c.cidr) {
+				t.Fatalf("ipnet %v expected %s", rule.ipnet, c.cidr)
+			}
+			if len(c.cidr) == 0 && rule.ipnet != nil {
+				t.Fatalf("ipnet %v expected pattern", rule.ipnet)
+			}
+			if len(rule.ports) != len(c.ranges) {
+				t.Fatalf("ports %v expected %v", rule.ports, c.ranges)
+			}
+			for i, r := range c.ranges {
+				if rule.ports[i] != r {
+					t.Fatalf("ports %v expected %v", rule.ports, c.ranges)
+				}
+			}
+		})
+	}
+}
+
+func TestPoliciesCheck(t *testing.T) {
+	dao := &policiesDao{policies: []*PolicyDro{
+		{Ship: "lan", Host: "*.lan", Ports: "80,443"},
+		{Ship: "lan", Host: "10.0.0.0/8", Ports: "8000-8100"},
+		{Ship: "lan", Host: "192.168.1.10", Ports: ""},
+		{Ship: "lan", Host: "fd00::/8", Ports: "22"},
+		{Ship: "lan", Host: "bad/cidr", Ports: ""},
+		{Ship: "web", Host: "www.example.com", Ports: "443"},
+	}}
+	cases := []struct {
+		name    string
+		deny    bool
+		ship    string
+		addr    string
+		allowed bool
+	}{
+		{"glob match", false, "lan", "printer.lan:80", true},
+		{"glob case", false, "lan", "PRINTER.LAN:443", true},
+		{"glob wrong port", false, "lan", "printer.lan:22", false},
+		{"glob no subdomain", false, "lan", "lan:80", false},
+		{"cidr range low", false, "lan", "10.1.2.3:8000", true},
+		{"cidr range high", false, "lan", "10.1.2.3:8100", true},
+		{"cidr out of range", false, "lan", "10.1.2.3:8101", false},
+		{"cidr other net", false, "lan", "11.1.2.3:8000", false},
+		{"cidr ipv4 mapped", false, "lan", "[::ffff:10.1.2.3]:8050", true},
+		{"single ip any port", false, "lan", "192.168.1.10:5432", true},
+		{"single ip mapped", false, "lan", "[::ffff:192.168.1.10]:5432", true},
+		{"single ip other", false, "lan", "192.168.1.11:5432", false},
+		{"ipv6 cidr", false, "lan", "[fd12::1]:22", true},
+		{"ipv6 cidr wrong port", false, "lan", "[fd12::1]:23", false},
+		{"hostname never matches cidr", false, "lan", "10.0.0.1.nip.io:8000", false},
+		{"ip does not match hostname", false, "web", "93.184.216.34:443", false},
+		{"exact host", false, "web", "www.example.com:443", true},
+		{"invalid destination", false, "lan", "printer.lan", false},
+		{"ship without rules", false, "open", "anything:1", true},
+		{"ship without rules deny", true, "open", "anything:1", false},
+		{"ship with rules deny", true, "lan", "printer.lan:80", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			policies := NewPolicies(dao, c.deny)
+			err := policies.Check(c.ship, c.addr)
+			if (err == nil) != c.allowed {
+				t.Fatalf("err %v allowed %v", err, c.allowed)
+			}
+			if err != nil && !rejectedDestination(err) {
+				t.Fatalf("err %v not a rejected destination", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/samuelventura/go-tools"
+	"github.com/samuelventura/go-tree"
+	"golang.org/x/crypto/ssh"
+)
+
+type tcpipForward struct { //RFC 4254 7.1
+	BindAddr string
+	BindPort uint32
+}
+
+type tcpipForwardReply struct {
+	BindPort uint32
+}
+
+type forwardedTcpip struct { //RFC 4254 7.2
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+func handleGlobalRequests(node tree.Node, reqs <-chan *ssh.Request) {
+	//stock ssh -R support, forwards are keyed by bound port
+	//since -R 0 forwards are cancelled with the allocated port
+	mutex := &sync.Mutex{}
+	forwards := make(map[uint32]tree.Node)
+	ship := node.GetValue("ship").(string)
+	id := NewId("tcpip-forward-" + ship)
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			payload, err := remoteForward(node, req.Payload, mutex, forwards, id)
+			if err != nil {
+				log.Println(req.Type, err)
+			}
+			if req.WantReply {
+				req.Reply(err == nil, payload)
+			}
+		case "cancel-tcpip-forward":
+			msg := &tcpipForward{}
+			err := ssh.Unmarshal(req.Payload, msg)
+			if err == nil {
+				mutex.Lock()
+				forward, ok := forwards[msg.BindPort]
+				mutex.Unlock()
+				if ok {
+					forward.Close()
+				} else {
+					err = fmt.Errorf("forward not found")
+				}
+			}
+			if req.WantReply {
+				req.Reply(err == nil, nil)
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func remoteForward(node tree.Node, payload []byte, mutex *sync.Mutex, forwards map[uint32]tree.Node, id Id) ([]byte, error) {
+	export := node.GetValue("export").(string)
+	ship := node.GetValue("ship").(string)
+	maxforwards := node.GetValue("maxforwards").(int64)
+	msg := &tcpipForward{}
+	err := ssh.Unmarshal(payload, msg)
+	if err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if int64(len(forwards)) >= maxforwards {
+		return nil, fmt.Errorf("max forwards %d", maxforwards)
+	}
+	//requested bind address is ignored, ports are bound on the export ip
+	listen, err := remoteListen(node, export, int(msg.BindPort))
+	if err != nil {
+		return nil, err
+	}
+	port := uint32(listen.Addr().(*net.TCPAddr).Port)
+	child := node.AddChild(id.Next(listen.Addr().String()))
+	child.AddCloser("listen", listen.Close)
+	child.AddAction("forwards", func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		delete(forwards, port)
+	})
+	forwards[port] = child
+	log.Println(ship, "tcpip-forward", msg.BindAddr, listen.Addr())
+	child.AddProcess("listen", func() {
+		id := NewId("forwarded-" + listen.Addr().String())
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				log.Println(port, err)
+				return
+			}
+			setupRemoteConnection(child, conn, id, msg.BindAddr, port)
+		}
+	})
+	if msg.BindPort == 0 {
+		return ssh.Marshal(&tcpipForwardReply{port}), nil
+	}
+	return nil, nil
+}
+
+func remoteListen(node tree.Node, export string, port int) (net.Listener, error) {
+	//configured ports stay reserved for their ships even while offline
+	dao := node.GetValue("dao").(Dao)
+	ship := node.GetValue("ship").(string)
+	min, max := dao.PortPool()
+	if min == 0 {
+		owners := dao.PortOwners(1, 65535)
+		if port != 0 {
+			if owner, ok := owners[port]; ok && owner != ship {
+				return nil, fmt.Errorf("port %d taken by %s", port, owner)
+			}
+			return net.Listen("tcp", net.JoinHostPort(export, strconv.Itoa(port)))
+		}
+		//ephemeral ports may land on a port configured for another ship
+		taken := []net.Listener{}
+		defer func() {
+			for _, listen := range taken {
+				listen.Close()
+			}
+		}()
+		for len(taken) < 8 {
+			listen, err := net.Listen("tcp", net.JoinHostPort(export, "0"))
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := owners[listen.Addr().(*net.TCPAddr).Port]; !ok {
+				return listen, nil
+			}
+			taken = append(taken, listen)
+		}
+		return nil, fmt.Errorf("no free ephemeral port")
+	}
+	owners := dao.PortOwners(min, max)
+	if port != 0 {
+		if port < min || port > max {
+			return nil, fmt.Errorf("port %d outside pool", port)
+		}
+		if owner, ok := owners[port]; ok && owner != ship {
+			return nil, fmt.Errorf("port %d taken by %s", port, owner)
+		}
+		return net.Listen("tcp", net.JoinHostPort(export, strconv.Itoa(port)))
+	}
+	for port = min; port <= max; port++ {
+		if _, ok := owners[port]; ok {
+			continue
+		}
+		listen, err := net.Listen("tcp", net.JoinHostPort(export, strconv.Itoa(port)))
+		if err == nil {
+			return listen, nil
+		}
+	}
+	return nil, fmt.Errorf("port pool exhausted")
+}
+
+func setupRemoteConnection(node tree.Node, conn net.Conn, id Id, addr string, port uint32) {
+	defer node.IfRecoverCloser(conn.Close)
+	raddr := conn.RemoteAddr().String()
+	cid := id.Next(raddr)
+	child := node.AddChild(cid)
+	child.AddCloser("conn", conn.Close)
+	child.AddProcess("conn", func() {
+		handleRemoteConnection(child, conn, addr, port)
+	})
+}
+
+func handleRemoteConnection(node tree.Node, conn net.Conn, addr string, port uint32) {
+	tools.KeepAlive(conn, 5)
+	ship := node.GetValue("ship").(string)
+	key := node.GetValue("key").(string)
+	sshConn := node.GetValue("ssh").(*ssh.ServerConn)
+	metrics := node.GetValue("metrics").(Metrics)
+	origin := conn.RemoteAddr().(*net.TCPAddr)
+	msg := &forwardedTcpip{addr, port, origin.IP.String(), uint32(origin.Port)}
+	sshChan, reqChan, err := sshConn.OpenChannel("forwarded-tcpip", ssh.Marshal(msg))
+	if err != nil {
+		metrics.ForwardFailed(ship)
+		log.Println(port, err)
+		return
+	}
+	pipeForward(node, conn, conn.RemoteAddr().String(), sshChan, reqChan, ship, key, port)
+}
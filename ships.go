@@ -14,8 +14,10 @@ type shipsDso struct {
 type Ships interface {
 	Get(name string) tree.Node
 	Del(name string, node tree.Node)
-	Add(name string, node tree.Node)
+	Add(name string, node tree.Node) tree.Node
 	Count() int
+	List() map[string]tree.Node
+	Close()
 }
 
 func NewShips() Ships {
@@ -31,7 +33,8 @@ func (dso *shipsDso) Get(name string) tree.Node {
 	return dso.ships[name]
 }
 
-func (dso *shipsDso) Add(name string, node tree.Node) {
+func (dso *shipsDso) Add(name string, node tree.Node) tree.Node {
+	//returns the replaced node if any
 	dso.mutex.Lock()
 	defer dso.mutex.Unlock()
 	curr, ok := dso.ships[name]
@@ -40,6 +43,7 @@ func (dso *shipsDso) Add(name string, node tree.Node) {
 		curr.Close()
 	}
 	dso.ships[name] = node
+	return curr
 }
 
 func (dso *shipsDso) Del(name string, node tree.Node) {
@@ -52,6 +56,25 @@ func (dso *shipsDso) Del(name string, node tree.Node) {
 	}
 }
 
+func (dso *shipsDso) Close() {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	for name, curr := range dso.ships {
+		delete(dso.ships, name)
+		curr.Close()
+	}
+}
+
+func (dso *shipsDso) List() map[string]tree.Node {
+	dso.mutex.Lock()
+	defer dso.mutex.Unlock()
+	list := make(map[string]tree.Node, len(dso.ships))
+	for name, node := range dso.ships {
+		list[name] = node
+	}
+	return list
+}
+
 func (dso *shipsDso) Count() int {
 	dso.mutex.Lock()
 	defer dso.mutex.Unlock()
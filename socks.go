@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const ( //RFC 1928
+	socksVersion = 0x05
+	socksConnect = 0x01
+
+	socksNoAuth       = 0x00
+	socksUserPass     = 0x02
+	socksNoAcceptable = 0xFF
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNotAllowed          = 0x02
+	socksNetworkUnreachable  = 0x03
+	socksHostUnreachable     = 0x04
+	socksConnectionRefused   = 0x05
+	socksTtlExpired          = 0x06
+	socksCommandNotSupported = 0x07
+	socksAddressNotSupported = 0x08
+)
+
+func socksHandshake(conn net.Conn, auth func(user, pass string) error) (string, error) {
+	//version byte already consumed by protocol detection
+	//auth requires username/password (RFC 1929) instead of no auth
+	ba := make([]byte, 1)
+	_, err := io.ReadFull(conn, ba)
+	if err != nil {
+		return "", err
+	}
+	methods := make([]byte, ba[0])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", err
+	}
+	want := byte(socksNoAuth)
+	if auth != nil {
+		want = socksUserPass
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	_, err = conn.Write([]byte{socksVersion, method})
+	if err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable && auth != nil {
+		return "", fmt.Errorf("%w: socks credentials required", errConsumerDenied)
+	}
+	if method == socksNoAcceptable {
+		return "", fmt.Errorf("socks no acceptable method")
+	}
+	if method == socksUserPass {
+		err = socksUserPassAuth(conn, auth)
+		if err != nil {
+			return "", err
+		}
+	}
+	return socksRequest(conn)
+}
+
+func socksUserPassAuth(conn net.Conn, auth func(user, pass string) error) error {
+	//RFC 1929 subnegotiation
+	readField := func() (string, error) {
+		ba := make([]byte, 1)
+		_, err := io.ReadFull(conn, ba)
+		if err != nil {
+			return "", err
+		}
+		field := make([]byte, ba[0])
+		_, err = io.ReadFull(conn, field)
+		return string(field), err
+	}
+	ver := make([]byte, 1)
+	_, err := io.ReadFull(conn, ver)
+	if err != nil {
+		return err
+	}
+	if ver[0] != 0x01 {
+		return fmt.Errorf("socks invalid auth version %d", ver[0])
+	}
+	user, err := readField()
+	if err != nil {
+		return err
+	}
+	pass, err := readField()
+	if err != nil {
+		return err
+	}
+	err = auth(user, pass)
+	status := byte(0x00)
+	if err != nil {
+		status = 0x01
+	}
+	_, werr := conn.Write([]byte{0x01, status})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+func socksRequest(conn net.Conn) (string, error) {
+	req := make([]byte, 4)
+	_, err := io.ReadFull(conn, req)
+	if err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", fmt.Errorf("socks invalid version %d", req[0])
+	}
+	if req[1] != socksConnect {
+		socksReply(conn, socksCommandNotSupported)
+		return "", fmt.Errorf("socks unsupported command %d", req[1])
+	}
+	var host string
+	switch req[3] {
+	case socksIPv4:
+		ip := make([]byte, net.IPv4len)
+		_, err = io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socksIPv6:
+		ip := make([]byte, net.IPv6len)
+		_, err = io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socksDomain:
+		ba := make([]byte, 1)
+		_, err = io.ReadFull(conn, ba)
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, ba[0])
+		_, err = io.ReadFull(conn, domain)
+		host = string(domain)
+	default:
+		socksReply(conn, socksAddressNotSupported)
+		return "", fmt.Errorf("socks unsupported address type %d", req[3])
+	}
+	if err != nil {
+		return "", err
+	}
+	pb := make([]byte, 2)
+	_, err = io.ReadFull(conn, pb)
+	if err != nil {
+		return "", err
+	}
+	port := int(pb[0])<<8 | int(pb[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+func socksReply(conn net.Conn, code byte) error {
+	//bound address is meaningless through the ssh channel
+	reply := []byte{socksVersion, code, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0}
+	_, err := conn.Write(reply)
+	return err
+}
+
+func socksCode(err error) byte {
+	if err == nil {
+		return socksSucceeded
+	}
+	if errors.Is(err, errForwardTimeout) {
+		return socksTtlExpired
+	}
+	if errors.Is(err, errPolicyDenied) || errors.Is(err, errConsumerDenied) {
+		return socksNotAllowed
+	}
+	if errors.Is(err, errInvalidDestination) {
+		return socksAddressNotSupported
+	}
+	var oce *ssh.OpenChannelError
+	if !errors.As(err, &oce) {
+		return socksGeneralFailure
+	}
+	switch oce.Reason {
+	case ssh.Prohibited:
+		return socksNotAllowed
+	case ssh.UnknownChannelType:
+		return socksCommandNotSupported
+	case ssh.ConnectionFailed:
+		//ship reports the dial error text as message
+		msg := strings.ToLower(oce.Message)
+		switch {
+		case strings.Contains(msg, "refused"):
+			return socksConnectionRefused
+		case strings.Contains(msg, "network is unreachable"):
+			return socksNetworkUnreachable
+		case strings.Contains(msg, "timeout"),
+			strings.Contains(msg, "timed out"):
+			return socksTtlExpired
+		}
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
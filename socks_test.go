@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func socksPipe(input []byte, run func(conn net.Conn) (string, error)) (string, []byte, error) {
+	//client writes the input and collects every reply until the server closes
+	//truncated inputs end with the deadline instead of blocking forever
+	server, client := net.Pipe()
+	server.SetDeadline(time.Now().Add(time.Second))
+	replies := make(chan []byte, 1)
+	go func() {
+		buf := bytes.NewBuffer(nil)
+		io.Copy(buf, client)
+		replies <- buf.Bytes()
+	}()
+	go client.Write(input)
+	addr, err := run(server)
+	server.Close()
+	return addr, <-replies, err
+}
+
+func socksBytes(parts ...interface{}) []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, part := range parts {
+		switch v := part.(type) {
+		case int:
+			buf.WriteByte(byte(v))
+		case string:
+			buf.WriteString(v)
+		case []byte:
+			buf.Write(v)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestSocksHandshake(t *testing.T) {
+	auth := func(user, pass string) error {
+		if user == "bob" && pass == "secret" {
+			return nil
+		}
+		return errConsumerDenied
+	}
+	ipv6 := net.ParseIP("2001:db8::1")
+	connect := []byte{socksVersion, socksConnect, 0x00}
+	badAddress := []byte{socksVersion, socksAddressNotSupported, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0}
+	unsupported := []byte{socksVersion, socksCommandNotSupported, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0}
+	cases := []struct {
+		name    string
+		auth    func(user, pass string) error
+		input   []byte
+		addr    string
+		replies []byte
+		denied  bool
+		fails   bool
+	}{
+		{"ipv4", nil,
+			socksBytes(1, socksNoAuth, connect, socksIPv4, 127, 0, 0, 1, 0x1F, 0x90),
+			"127.0.0.1:8080", []byte{socksVersion, socksNoAuth}, false, false},
+		{"ipv6", nil,
+			socksBytes(1, socksNoAuth, connect, socksIPv6, []byte(ipv6), 0x01, 0xBB),
+			"[2001:db8::1]:443", []byte{socksVersion, socksNoAuth}, false, false},
+		{"domain", nil,
+			socksBytes(1, socksNoAuth, connect, socksDomain, 11, "example.com", 0x00, 0x50),
+			"example.com:80", []byte{socksVersion, socksNoAuth}, false, false},
+		{"noauth among methods", nil,
+			socksBytes(2, socksUserPass, socksNoAuth, connect, socksIPv4, 10, 0, 0, 1, 0x00, 0x16),
+			"10.0.0.1:22", []byte{socksVersion, socksNoAuth}, false, false},
+		{"unsupported address", nil,
+			socksBytes(1, socksNoAuth, connect, 0x05),
+			"", append([]byte{socksVersion, socksNoAuth}, badAddress...), false, true},
+		{"unsupported command", nil,
+			socksBytes(1, socksNoAuth, socksVersion, 0x02, 0x00, socksIPv4),
+			"", append([]byte{socksVersion, socksNoAuth}, unsupported...), false, true},
+		{"invalid request version", nil,
+			socksBytes(1, socksNoAuth, 0x04, socksConnect, 0x00, socksIPv4),
+			"", []byte{socksVersion, socksNoAuth}, false, true},
+		{"no acceptable method", nil,
+			socksBytes(1, socksUserPass),
+			"", []byte{socksVersion, socksNoAcceptable}, false, true},
+		{"credentials required", auth,
+			socksBytes(1, socksNoAuth),
+			"", []byte{socksVersion, socksNoAcceptable}, true, true},
+		{"credentials accepted", auth,
+			socksBytes(2, socksNoAuth, socksUserPass, 0x01, 3, "bob", 6, "secret",
+				connect, socksIPv4, 192, 168, 1, 10, 0x01, 0xBB),
+			"192.168.1.10:443", []byte{socksVersion, socksUserPass, 0x01, 0x00}, false, false},
+		{"credentials rejected", auth,
+			socksBytes(1, socksUserPass, 0x01, 3, "bob", 5, "wrong"),
+			"", []byte{socksVersion, socksUserPass, 0x01, 0x01}, true, true},
+		{"invalid auth version", auth,
+			socksBytes(1, socksUserPass, 0x05, 3, "bob", 6, "secret"),
+			"", []byte{socksVersion, socksUserPass}, false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr, replies, err := socksPipe(c.input, func(conn net.Conn) (string, error) {
+				return socksHandshake(conn, c.auth)
+			})
+			if (err != nil) != c.fails {
+				t.Fatalf("err %v fails %v", err, c.fails)
+			}
+			if errors.Is(err, errConsumerDenied) != c.denied {
+				t.Fatalf("err %v denied %v", err, c.denied)
+			}
+			if addr != c.addr {
+				t.Fatalf("addr %q expected %q", addr, c.addr)
+			}
+			if !bytes.Equal(replies, c.replies) {
+				t.Fatalf("replies %v expected %v", replies, c.replies)
+			}
+		})
+	}
+}
+
+func TestSocksUserPassAuth(t *testing.T) {
+	cases := []struct {
+		name    string
+		input   []byte
+		user    string
+		pass    string
+		replies []byte
+		fails   bool
+	}{
+		{"accepted", socksBytes(0x01, 3, "bob", 6, "secret"), "bob", "secret", []byte{0x01, 0x00}, false},
+		{"empty fields", socksBytes(0x01, 0, 0), "", "", []byte{0x01, 0x01}, true},
+		{"rejected", socksBytes(0x01, 5, "alice", 6, "secret"), "alice", "secret", []byte{0x01, 0x01}, true},
+		{"invalid version", socksBytes(0x02, 3, "bob", 6, "secret"), "", "", nil, true},
+		{"truncated", socksBytes(0x01, 3, "bo"), "", "", nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			user, pass := "", ""
+			auth := func(u, p string) error {
+				user, pass = u, p
+				if u == "bob" && p == "secret" {
+					return nil
+				}
+				return errConsumerDenied
+			}
+			_, replies, err := socksPipe(c.input, func(conn net.Conn) (string, error) {
+				return "", socksUserPassAuth(conn, auth)
+			})
+			if (err != nil) != c.fails {
+				t.Fatalf("err %v fails %v", err, c.fails)
+			}
+			if user != c.user || pass != c.pass {
+				t.Fatalf("credentials %q %q expected %q %q", user, pass, c.user, c.pass)
+			}
+			if !bytes.Equal(replies, c.replies) {
+				t.Fatalf("replies %v expected %v", replies, c.replies)
+			}
+		})
+	}
+}
+
+func TestSocksRequest(t *testing.T) {
+	cases := []struct {
+		name  string
+		input []byte
+		addr  string
+		fails bool
+	}{
+		{"ipv4", socksBytes(socksVersion, socksConnect, 0, socksIPv4, 8, 8, 8, 8, 0x00, 0x35), "8.8.8.8:53", false},
+		{"ipv4 mapped ipv6", socksBytes(socksVersion, socksConnect, 0, socksIPv6,
+			[]byte(net.ParseIP("::ffff:10.1.2.3")), 0x00, 0x50), "10.1.2.3:80", false},
+		{"ipv6 loopback", socksBytes(socksVersion, socksConnect, 0, socksIPv6,
+			[]byte(net.IPv6loopback), 0xFF, 0xFF), "[::1]:65535", false},
+		{"empty domain", socksBytes(socksVersion, socksConnect, 0, socksDomain, 0, 0x00, 0x50), ":80", false},
+		{"truncated ipv4", socksBytes(socksVersion, socksConnect, 0, socksIPv4, 8, 8), "", true},
+		{"truncated port", socksBytes(socksVersion, socksConnect, 0, socksDomain, 1, "a", 0x00), "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr, _, err := socksPipe(c.input, socksRequest)
+			if (err != nil) != c.fails {
+				t.Fatalf("err %v fails %v", err, c.fails)
+			}
+			if addr != c.addr {
+				t.Fatalf("addr %q expected %q", addr, c.addr)
+			}
+		})
+	}
+}
+
+func TestSocksCode(t *testing.T) {
+	failed := func(msg string) error {
+		return &ssh.OpenChannelError{Reason: ssh.ConnectionFailed, Message: msg}
+	}
+	cases := []struct {
+		name string
+		err  error
+		code byte
+	}{
+		{"success", nil, socksSucceeded},
+		{"forward timeout", errForwardTimeout, socksTtlExpired},
+		{"policy denied", fmt.Errorf("%w: 10.0.0.1:22", errPolicyDenied), socksNotAllowed},
+		{"consumer denied", errConsumerDenied, socksNotAllowed},
+		{"invalid destination", fmt.Errorf("%w: x", errInvalidDestination), socksAddressNotSupported},
+		{"prohibited", &ssh.OpenChannelError{Reason: ssh.Prohibited}, socksNotAllowed},
+		{"unknown channel", &ssh.OpenChannelError{Reason: ssh.UnknownChannelType}, socksCommandNotSupported},
+		{"resource shortage", &ssh.OpenChannelError{Reason: ssh.ResourceShortage}, socksGeneralFailure},
+		{"refused", failed("dial tcp 127.0.0.1:1: connect: connection refused"), socksConnectionRefused},
+		{"network unreachable", failed("connect: Network is unreachable"), socksNetworkUnreachable},
+		{"dial timeout", failed("dial tcp 10.0.0.1:22: i/o timeout"), socksTtlExpired},
+		{"timed out", failed("connection timed out"), socksTtlExpired},
+		{"no such host", failed("lookup nowhere: no such host"), socksHostUnreachable},
+		{"other error", io.EOF, socksGeneralFailure},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			code := socksCode(c.err)
+			if code != c.code {
+				t.Fatalf("code %d expected %d", code, c.code)
+			}
+		})
+	}
+}
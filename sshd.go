@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,11 +17,14 @@ import (
 
 func sshd(node tree.Node) {
 	dao := node.GetValue("dao").(Dao)
+	keys := node.GetValue("keys").(Keys)
+	acls := node.GetValue("acls").(Acls)
 	ships := node.GetValue("ships").(Ships)
 	hostname := node.GetValue("hostname").(string)
 	endpoint := node.GetValue("endpoint").(string)
 	hostkey := node.GetValue("hostkey").(string)
-	maxships := node.GetValue("maxships").(int64)
+	metrics := node.GetValue("metrics").(Metrics)
+	limiter := node.GetValue("limiter").(Limiter)
 	privateBytes, err := ioutil.ReadFile(hostkey)
 	if err != nil {
 		log.Panicln(err)
@@ -29,20 +33,40 @@ func sshd(node tree.Node) {
 	if err != nil {
 		log.Panicln(err)
 	}
+	keyAuth := func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if cert, ok := key.(*ssh.Certificate); ok {
+			return certAuth(keys, conn, cert)
+		}
+		found := keys.Find(key)
+		if found == nil {
+			return nil, fmt.Errorf("key not found")
+		}
+		//admin keys reach every ship as operators
+		if found.Role == roleAdmin {
+			return &ssh.Permissions{Extensions: map[string]string{
+				"key-id": found.Name, "role": roleAdmin}}, nil
+		}
+		if !keys.IsGranted(found.Name, conn.User()) {
+			return nil, fmt.Errorf("ship not granted")
+		}
+		return &ssh.Permissions{Extensions: map[string]string{"key-id": found.Name}}, nil
+	}
 	config := &ssh.ServerConfig{
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			inkey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
-			for _, key := range dao.EnabledKeys() {
-				pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
-				if err != nil {
-					log.Panicln("Ignoring invalid key", key.Name)
-				}
-				pubtxt := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubkey)))
-				if pubtxt == inkey {
-					return &ssh.Permissions{Extensions: map[string]string{"key-id": key.Name}}, nil
+			perms, err := keyAuth(conn, key)
+			if err != nil {
+				return nil, err
+			}
+			//certificates match rules of their key id and ca
+			ip := addrIP(conn.RemoteAddr())
+			for _, name := range []string{perms.Extensions["key-id"], perms.Extensions["ca-id"]} {
+				if len(name) > 0 && !acls.Allowed(aclKey, name, ip) {
+					dao.AddAudit("", "acl-denied", conn.User(), name, "", hostname,
+						conn.RemoteAddr().String())
+					return nil, fmt.Errorf("key acl denied")
 				}
 			}
-			return nil, fmt.Errorf("key not found")
+			return perms, nil
 		},
 	}
 	config.AddHostKey(private)
@@ -55,6 +79,18 @@ func sshd(node tree.Node) {
 	port := listen.Addr().(*net.TCPAddr).Port
 	log.Println("port ssh", port)
 	node.SetValue("port", port)
+	//denials are audited off the accept loop, floods only count in metrics
+	denied := make(chan string, 64)
+	node.AddProcess("denied", func() {
+		for {
+			select {
+			case addr := <-denied:
+				dao.AddAudit("", "acl-denied", "", "", "", hostname, addr)
+			case <-node.Closed():
+				return
+			}
+		}
+	})
 	node.AddProcess("listen", func() {
 		id := NewId("ssh-" + hostname + "-" + listen.Addr().String())
 		for {
@@ -63,9 +99,25 @@ func sshd(node tree.Node) {
 				log.Println(err)
 				return
 			}
-			count := int64(ships.Count())
-			if count >= maxships {
-				log.Println("max ships", maxships, count)
+			//checked before any handshake work
+			ip := addrIP(tcpConn.RemoteAddr())
+			if !acls.Allowed(aclGlobal, "", ip) {
+				select {
+				case denied <- tcpConn.RemoteAddr().String():
+				default:
+				}
+				metrics.Handshake("acl")
+				tcpConn.Close()
+				continue
+			}
+			if limiter.Banned(ip.String()) {
+				metrics.Handshake("banned")
+				tcpConn.Close()
+				continue
+			}
+			if !limiter.Connect(ip.String()) {
+				log.Println("rate limit", ip)
+				metrics.Handshake("ratelimit")
 				tcpConn.Close()
 				continue
 			}
@@ -91,56 +143,128 @@ func handleSshConnection(node tree.Node, tcpConn net.Conn, ships Ships) {
 	export := node.GetValue("export").(string)
 	hostname := node.GetValue("hostname").(string)
 	config := node.GetValue("config").(*ssh.ServerConfig)
-	sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, config)
+	metrics := node.GetValue("metrics").(Metrics)
+	events := node.GetValue("events").(Events)
+	limiter := node.GetValue("limiter").(Limiter)
+	acls := node.GetValue("acls").(Acls)
+	maxships := node.GetValue("maxships").(int64)
+	handshake := time.Duration(node.GetValue("handshake").(int64)) * time.Second
+	//per connection copy to learn the user of failed attempts
+	user := ""
+	connConfig := *config
+	connConfig.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		user = conn.User()
+	}
+	//silent clients would hang the handshake forever
+	err := tcpConn.SetDeadline(time.Now().Add(handshake))
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, &connConfig)
+	if err != nil {
+		var authErr *ssh.ServerAuthError
+		var netErr net.Error
+		switch {
+		case errors.As(err, &authErr):
+			metrics.Handshake("auth")
+			ip := addrIP(tcpConn.RemoteAddr()).String()
+			events.Publish(&Event{Type: "auth-failed", Ship: user, Sid: node.Name(),
+				Host: hostname, Detail: tcpConn.RemoteAddr().String()})
+			if limiter.Failed(ip) {
+				log.Println("banned", ip)
+				events.Publish(&Event{Type: "banned", Ship: user, Sid: node.Name(),
+					Host: hostname, Detail: ip})
+			}
+		case errors.As(err, &netErr) && netErr.Timeout():
+			metrics.Handshake("timeout")
+		default:
+			metrics.Handshake("handshake")
+		}
+		log.Println(err)
+		return
+	}
+	err = tcpConn.SetDeadline(time.Time{})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if sshConn.Permissions.Extensions["role"] == roleAdmin {
+		metrics.Handshake("operator")
+		handleOperator(node, sshConn, chans, reqs)
+		return
+	}
 	ship := sshConn.User()
+	if !acls.Allowed(aclShip, ship, addrIP(tcpConn.RemoteAddr())) {
+		dao.AddAudit(node.Name(), "acl-denied", ship, sshConn.Permissions.Extensions["key-id"],
+			"", hostname, tcpConn.RemoteAddr().String())
+		metrics.Handshake("acl")
+		return
+	}
+	//reconnecting ships replace their session and are never over the limit
+	count := int64(ships.Count())
+	if ships.Get(ship) == nil && count >= maxships {
+		log.Println("max ships", maxships, count)
+		metrics.Handshake("maxships")
+		return
+	}
 	dro, err := dao.GetShip(ship)
 	if err != nil || !dro.Enabled {
+		metrics.Handshake("ship")
 		log.Println(ship, dro.Enabled, err)
 		return
 	}
 	node.AddCloser("sshConn", sshConn.Close)
 	node.SetValue("ssh", sshConn)
-	endpoint := fmt.Sprintf("%s:%d", export, dro.Port)
-	listen, err := net.Listen("tcp", endpoint)
+	node.SetValue("ship", ship)
+	node.SetValue("since", time.Now())
+	node.SetValue("remote", tcpConn.RemoteAddr().String())
+	listen, proxy, port, err := exportListen(node, ship, dro.Port)
 	if err != nil {
+		metrics.Handshake("listen")
 		log.Println(err)
 		return
 	}
 	node.AddCloser("listen", listen.Close)
-	port := listen.Addr().(*net.TCPAddr).Port
 	key := sshConn.Permissions.Extensions["key-id"]
-	node.SetValue("proxy", port)
+	node.SetValue("proxy", proxy)
+	node.SetValue("proxyport", port)
+	node.SetValue("proxyauth", dro.Auth)
 	node.SetValue("key", key)
 	//replace ship by name, ensure sport already defined
-	ships.Add(ship, node)
+	replaced := ships.Add(ship, node)
 	defer ships.Del(ship, node)
-	log.Println(ship, port, tcpConn.RemoteAddr(), ships.Count())
-	dao.ShipStart(node.Name(), ship, key, hostname, export, port)
+	if replaced != nil {
+		events.Publish(&Event{Type: "replaced", Ship: ship, Sid: replaced.Name(),
+			Host: hostname, Detail: node.Name()})
+	}
+	log.Println(ship, proxy, tcpConn.RemoteAddr(), ships.Count())
+	dao.ShipStart(node.Name(), ship, key, hostname, export, port, exportPath(proxy, port))
+	metrics.Handshake("success")
+	events.Publish(&Event{Type: "docked", Ship: ship, Sid: node.Name(), Key: key, Host: hostname})
+	defer events.Publish(&Event{Type: "undocked", Ship: ship, Sid: node.Name(), Key: key, Host: hostname})
 	defer dao.ShipStop(node.Name(), ship, key, hostname, export, port)
 	node.AddProcess("ssh chans reject", func() {
 		for nch := range chans {
 			nch.Reject(ssh.Prohibited, "unsupported")
 		}
 	})
-	node.AddProcess("ssh reqs reply", func() {
-		for req := range reqs {
-			if req.WantReply {
-				req.Reply(false, nil)
-			}
-		}
+	node.AddProcess("ssh reqs handler", func() {
+		handleGlobalRequests(node, reqs)
 	})
 	node.AddProcess("ssh ping handler", func() {
 		for {
-			dl := time.Now().Add(10 * time.Second)
-			resp, _, err := sshConn.SendRequest("ping", true, nil)
-			if time.Now().After(dl) || err != nil || !resp {
-				log.Println(port, "ping timeout")
+			start := time.Now()
+			dl := start.Add(10 * time.Second)
+			//stock ssh clients reply false to unknown requests
+			_, _, err := sshConn.SendRequest("ping", true, nil)
+			if time.Now().After(dl) || err != nil {
+				log.Println(proxy, "ping timeout")
+				events.Publish(&Event{Type: "ping-timeout", Ship: ship, Sid: node.Name(),
+					Key: key, Host: hostname})
 				return
 			}
+			metrics.PingRtt(time.Since(start).Seconds())
 			timer := time.NewTimer(5 * time.Second)
 			select {
 			case <-timer.C:
@@ -151,11 +275,11 @@ func handleSshConnection(node tree.Node, tcpConn net.Conn, ships Ships) {
 			}
 		}
 	})
-	id := NewId("proxy-" + listen.Addr().String())
+	id := NewId("proxy-" + proxy)
 	for {
 		proxyConn, err := listen.Accept()
 		if err != nil {
-			log.Println(port, err)
+			log.Println(proxy, err)
 			break
 		}
 		setupProxyConnection(node, proxyConn, id)
@@ -174,61 +298,165 @@ func setupProxyConnection(node tree.Node, proxyConn net.Conn, id Id) {
 }
 
 func handleProxyConnection(node tree.Node, proxyConn net.Conn) {
-	tools.KeepAlive(proxyConn, 5)
-	port := node.GetValue("proxy").(int)
+	//keep alive panics on unix sockets
+	if _, ok := proxyConn.(*net.TCPConn); ok {
+		tools.KeepAlive(proxyConn, 5)
+	}
+	dao := node.GetValue("dao").(Dao)
+	port := node.GetValue("proxy").(string)
+	ship := node.GetValue("ship").(string)
+	mode := node.GetValue("proxyauth").(string)
+	hostname := node.GetValue("hostname").(string)
 	sshConn := node.GetValue("ssh").(*ssh.ServerConn)
-	err := proxyConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	metrics := node.GetValue("metrics").(Metrics)
+	remote := proxyConn.RemoteAddr().String()
+	consumer := ""
+	var err error
+	if mode == consumerTls {
+		proxyConn, consumer, err = consumerTlsHandshake(node, proxyConn)
+		if err == nil {
+			//the certificate proves identity, no secret involved
+			_, err = consumerEnabled(dao, ship, consumer)
+		}
+		if err != nil {
+			dao.AddAudit(node.Name(), "consumer-denied", ship, "", consumer, hostname, remote)
+			log.Println(port, err)
+			return
+		}
+	}
+	//credentials are checked in the mode chosen for the ship
+	authorize := func(name, secret string) error {
+		consumer = name
+		return consumerAuth(dao, ship, name, secret)
+	}
+	err = proxyConn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	if err != nil {
 		log.Println(port, err)
 		return
 	}
-	var sb strings.Builder
+	//protocol is detected from the first byte
 	ba := make([]byte, 1)
-	for {
-		n, err := proxyConn.Read(ba)
-		if err != nil {
-			log.Println(port, err)
-			return
+	_, err = io.ReadFull(proxyConn, ba)
+	if err != nil {
+		log.Println(port, err)
+		return
+	}
+	socks := ba[0] == socksVersion
+	connect := false
+	var addr string
+	var denied error
+	if socks {
+		var auth func(user, pass string) error
+		switch mode {
+		case consumerPassword:
+			auth = authorize
+		case consumerToken:
+			auth = func(user, pass string) error { return errConsumerDenied }
 		}
-		if n != 1 {
-			log.Println(port, fmt.Errorf("invalid read %d", n))
-			return
+		addr, err = socksHandshake(proxyConn, auth)
+		if errors.Is(err, errConsumerDenied) {
+			denied, err = err, nil
 		}
-		err = sb.WriteByte(ba[0])
-		if err != nil {
-			log.Println(port, err)
-			return
+	} else {
+		addr, err = readLine(proxyConn, ba[0])
+		connect = err == nil && isConnect(addr)
+		switch {
+		case connect:
+			var header string
+			addr, header, err = connectRequest(proxyConn, addr)
+			if err == nil && mode == consumerPassword {
+				name, secret, ok := basicAuth(header)
+				denied = errConsumerDenied
+				if ok {
+					denied = authorize(name, secret)
+				}
+			} else if err == nil && mode == consumerToken {
+				denied = errConsumerDenied
+			}
+		case err == nil && mode == consumerToken:
+			name, secret, dest, ok := tokenLine(addr)
+			addr = dest
+			denied = errConsumerDenied
+			if ok {
+				denied = authorize(name, secret)
+			}
+		case err == nil && mode == consumerPassword:
+			denied = errConsumerDenied
 		}
-		if ba[0] == 0x0A {
-			break
+	}
+	if err != nil {
+		log.Println(port, err)
+		return
+	}
+	if denied != nil {
+		dao.AddAudit(node.Name(), "consumer-denied", ship, "", consumer, hostname, remote)
+		switch {
+		case connect:
+			code, status := connectStatus(denied)
+			connectReply(proxyConn, code, status)
+		case !socks:
+			fmt.Fprintf(proxyConn, "err: %v\n", denied)
 		}
+		log.Println(port, denied)
+		return
 	}
 	err = proxyConn.SetReadDeadline(time.Time{})
 	if err != nil {
 		log.Println(port, err)
 		return
 	}
-	addr := strings.TrimSpace(sb.String())
-	sshChan, reqChan, err := sshConn.OpenChannel("forward", []byte(addr))
+	key := node.GetValue("key").(string)
+	var sshChan ssh.Channel
+	var reqChan <-chan *ssh.Request
+	err = checkDestination(node, ship, key, addr)
+	if err == nil && mode != consumerNone {
+		dao.AddAudit(node.Name(), "consumer", ship, "", consumer, hostname, addr)
+	}
+	if err == nil {
+		sshChan, reqChan, err = openForward(sshConn, addr)
+	}
+	var rerr error
+	switch {
+	case socks:
+		rerr = socksReply(proxyConn, socksCode(err))
+	case connect:
+		code, status := connectStatus(err)
+		rerr = connectReply(proxyConn, code, status)
+	case rejectedDestination(err):
+		//plain lines have no reply, rejections are explicit anyway
+		_, rerr = fmt.Fprintf(proxyConn, "err: %v\n", err)
+	}
+	if err == nil && rerr != nil {
+		go ssh.DiscardRequests(reqChan)
+		sshChan.Close()
+		err = rerr
+	}
 	if err != nil {
+		metrics.ForwardFailed(ship)
 		log.Println(port, err)
 		return
 	}
-	node.AddCloser("sshChan", sshChan.Close)
-	node.AddProcess("DiscardRequests(reqChan)", func() {
-		ssh.DiscardRequests(reqChan)
-	})
-	node.AddProcess("Copy(sshChan, proxyConn)", func() {
-		_, err := io.Copy(sshChan, proxyConn)
+	pipeForward(node, proxyConn, proxyConn.RemoteAddr().String(), sshChan, reqChan, ship, key, port)
+}
+
+func readLine(conn net.Conn, first byte) (string, error) {
+	var sb strings.Builder
+	ba := []byte{first}
+	for {
+		err := sb.WriteByte(ba[0])
 		if err != nil {
-			log.Println(port, err)
+			return "", err
 		}
-	})
-	node.AddProcess("Copy(proxyConn, sshChan)", func() {
-		_, err := io.Copy(proxyConn, sshChan)
+		if ba[0] == 0x0A {
+			break
+		}
+		n, err := conn.Read(ba)
 		if err != nil {
-			log.Println(port, err)
+			return "", err
 		}
-	})
-	node.WaitClosed()
+		if n != 1 {
+			return "", fmt.Errorf("invalid read %d", n)
+		}
+	}
+	return strings.TrimSpace(sb.String()), nil
 }